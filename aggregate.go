@@ -0,0 +1,636 @@
+package patman
+
+import (
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aggregator accumulates the matches of a pipeline until input ends
+type aggregator interface {
+	add(match string)
+
+	// merge adds the matches accumulated by other, an aggregator
+	// of the same kind, as if they were added to this one
+	merge(other aggregator)
+
+	// fields returns the [value, name] pairs printed
+	// for a pipeline named name
+	fields(name string) [][]string
+}
+
+// aggregators holds the constructors of aggregate operators.
+// Aggregate operators must be the last of a pipeline, optionally followed by name
+var aggregators = map[string]func(arg string) aggregator{
+	"count": func(arg string) aggregator { return &countAggregator{} },
+	"sum":   func(arg string) aggregator { return &sumAggregator{} },
+	"avg":   func(arg string) aggregator { return &avgAggregator{} },
+	"min":   func(arg string) aggregator { return &minAggregator{min: math.Inf(1)} },
+	"max":   func(arg string) aggregator { return &maxAggregator{max: math.Inf(-1)} },
+
+	"percentiles": newPercentilesAggregator,
+	"histogram":   newHistogramAggregator,
+	"topk":        newTopkAggregator,
+	"distinct":    func(arg string) aggregator { return &distinctAggregator{hll: newHyperLogLog()} },
+}
+
+type aggregatePipeline struct {
+	name string
+	cmd  Command
+}
+
+// aggregatePipelines holds the pipelines ending with an aggregate operator
+var aggregatePipelines []aggregatePipeline
+
+// aggregateGroup holds the aggregators of a -groupby value
+// within a -window, when configured
+type aggregateGroup struct {
+	id string
+
+	// [match, name] of the groupby pipeline, nil when not grouping
+	key  []string
+	aggs []aggregator
+
+	// start of the time window, zero when not windowing
+	window time.Time
+
+	// first is the position of the first record of the group,
+	// used to print groups in order of appearance
+	first int64
+}
+
+// aggregation holds the groups of aggregated records
+type aggregation struct {
+	groups map[string]*aggregateGroup
+	order  []*aggregateGroup
+
+	// maxEventTime is the latest time seen on the -time-field pipeline.
+	// Windows ending before maxEventTime - lateness are complete
+	maxEventTime time.Time
+
+	// nextClose is the end of the earliest open window
+	nextClose time.Time
+
+	// late counts records belonging to windows already printed,
+	// untimed the ones without a valid time
+	late    int
+	untimed int
+}
+
+func newAggregation() *aggregation {
+	return &aggregation{groups: map[string]*aggregateGroup{}}
+}
+
+// aggregates is the aggregation fed by the collector, or by
+// syncScan. Per worker aggregations are merged into it once input ends
+var aggregates = newAggregation()
+
+// aggregated counts the records fed to aggregates
+var aggregated int64
+
+// setupAggregation finds the aggregate pipelines, validating them against -groupby
+func setupAggregation() {
+	for _, cmds := range pipelines {
+		var name string
+		last := len(cmds) - 1
+		if cmds[last].Name == "name" {
+			name = cmds[last].Arg
+			last--
+		}
+
+		for i, cmd := range cmds {
+			if _, ok := aggregators[cmd.Name]; !ok {
+				continue
+			}
+			if i != last {
+				fatalf("aggregate operator `%s` must be the last operator of a pipeline", cmd.Name)
+			}
+			if name == "" {
+				fatalf("aggregate operator `%s` must be in a named pipeline", cmd.Name)
+			}
+			// fail early on invalid arguments
+			aggregators[cmd.Name](cmd.Arg)
+			aggregatePipelines = append(aggregatePipelines, aggregatePipeline{name: name, cmd: cmd})
+		}
+	}
+
+	if windowSize > 0 {
+		if len(aggregatePipelines) == 0 {
+			fatalf("window requires at least one aggregate pipeline")
+		}
+		if !slices.Contains(pipelineNames, timeField) {
+			fatalf("window requires a -time-field with a matching named pipeline")
+		}
+	}
+
+	if groupBy == "" {
+		return
+	}
+	if len(aggregatePipelines) == 0 {
+		fatalf("groupby `%s` requires at least one aggregate pipeline", groupBy)
+	}
+	if !slices.Contains(pipelineNames, groupBy) {
+		fatalf("groupby `%s` must have a matching named pipeline", groupBy)
+	}
+}
+
+func aggregating() bool {
+	return len(aggregatePipelines) > 0
+}
+
+// aggregatingInWorkers reports whether workers can aggregate lines on their
+// own, merging their aggregations once input ends. Index groups,
+// windows and time ranges depend on input order, so they cannot.
+// Neither can -count and -max-count, which only see printed records
+func aggregatingInWorkers() bool {
+	return aggregating() &&
+		!countMatches &&
+		maxCount == 0 &&
+		index == "" &&
+		windowSize == 0 &&
+		sinceTime.IsZero() &&
+		untilTime.IsZero()
+}
+
+// add feeds a record to the aggregators of its group. seq is the
+// position of the record in input. When windowing, windows
+// completed by the record are printed
+func (a *aggregation) add(results [][]string, seq int64, print printer) {
+	var key []string
+	if groupBy != "" {
+		for _, result := range results {
+			if result[1] == groupBy && result[0] != "" {
+				key = result
+			}
+		}
+		if key == nil {
+			return
+		}
+	}
+
+	var start time.Time
+	if windowSize > 0 {
+		t, ok := recordTime(results)
+		if !ok {
+			a.untimed++
+			return
+		}
+
+		start = t.Truncate(windowSize)
+		if !start.Add(windowSize).After(a.watermark()) {
+			a.late++
+			return
+		}
+		if t.After(a.maxEventTime) {
+			a.maxEventTime = t
+		}
+	}
+
+	var id string
+	if key != nil {
+		id = key[0]
+	}
+	if windowSize > 0 {
+		id = strconv.FormatInt(start.UnixNano(), 10) + "\x00" + id
+	}
+
+	g, ok := a.groups[id]
+	if !ok {
+		g = &aggregateGroup{id: id, key: key, window: start, first: seq}
+		for _, p := range aggregatePipelines {
+			g.aggs = append(g.aggs, aggregators[p.cmd.Name](p.cmd.Arg))
+		}
+		a.groups[id] = g
+		a.order = append(a.order, g)
+
+		if end := start.Add(windowSize); windowSize > 0 && (a.nextClose.IsZero() || end.Before(a.nextClose)) {
+			a.nextClose = end
+		}
+	}
+
+	for _, result := range results {
+		for i, p := range aggregatePipelines {
+			if result[1] == p.name {
+				g.aggs[i].add(result[0])
+			}
+		}
+	}
+
+	if windowSize > 0 && !a.nextClose.After(a.watermark()) {
+		a.closeWindows(print)
+	}
+}
+
+// merge adds the groups of other to a
+func (a *aggregation) merge(other *aggregation) {
+	for _, o := range other.order {
+		g, ok := a.groups[o.id]
+		if !ok {
+			a.groups[o.id] = o
+			a.order = append(a.order, o)
+			continue
+		}
+
+		g.first = min(g.first, o.first)
+		for i, agg := range g.aggs {
+			agg.merge(o.aggs[i])
+		}
+	}
+	a.late += other.late
+	a.untimed += other.untimed
+}
+
+// watermark is the time before which all records are
+// assumed to be seen, allowing -lateness for out of order ones
+func (a *aggregation) watermark() time.Time {
+	return a.maxEventTime.Add(-lateness)
+}
+
+func recordTime(results [][]string) (time.Time, bool) {
+	for _, result := range results {
+		if result[1] == timeField {
+			t, err := parseTime(result[0])
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// closeWindows prints the windows ending before the watermark
+func (a *aggregation) closeWindows(print printer) {
+	var closed, open []*aggregateGroup
+	a.nextClose = time.Time{}
+	for _, g := range a.order {
+		end := g.window.Add(windowSize)
+		if !end.After(a.watermark()) {
+			closed = append(closed, g)
+			delete(a.groups, g.id)
+			continue
+		}
+		open = append(open, g)
+		if a.nextClose.IsZero() || end.Before(a.nextClose) {
+			a.nextClose = end
+		}
+	}
+	a.order = open
+
+	printAggregates(closed, print)
+}
+
+// flush prints a record for every group once input ends
+func (a *aggregation) flush(print printer) {
+	printAggregates(a.order, print)
+
+	if a.late > 0 {
+		log.Printf("%d records arrived after their window was printed and were skipped, consider increasing -lateness", a.late)
+	}
+	if a.untimed > 0 {
+		log.Printf("%d records without a valid `%s` time were skipped", a.untimed, timeField)
+	}
+}
+
+// printAggregates prints a record per group, ordered
+// by window when windowing, then by appearance
+func printAggregates(groups []*aggregateGroup, print printer) {
+	slices.SortStableFunc(groups, func(a, b *aggregateGroup) int {
+		if c := a.window.Compare(b.window); c != 0 {
+			return c
+		}
+		return int(a.first - b.first)
+	})
+
+	for _, g := range groups {
+		var record [][]string
+		if windowSize > 0 {
+			record = append(record, []string{g.window.Format(time.RFC3339), "window"})
+		}
+		if g.key != nil {
+			record = append(record, g.key)
+		}
+		for i, p := range aggregatePipelines {
+			record = append(record, g.aggs[i].fields(p.name)...)
+		}
+
+		if columns == nil {
+			for _, field := range record {
+				columns = append(columns, field[1])
+			}
+		}
+
+		print(record)
+	}
+}
+
+func parseNumber(match string) (float64, bool) {
+	num, err := strconv.ParseFloat(strings.TrimSpace(match), 64)
+	return num, err == nil
+}
+
+func formatNumber(num float64) string {
+	return strconv.FormatFloat(num, 'f', -1, 64)
+}
+
+type countAggregator struct {
+	count int
+}
+
+func (a *countAggregator) add(match string) {
+	a.count++
+}
+
+func (a *countAggregator) merge(other aggregator) {
+	a.count += other.(*countAggregator).count
+}
+
+func (a *countAggregator) fields(name string) [][]string {
+	return [][]string{{strconv.Itoa(a.count), name}}
+}
+
+// numeric aggregators skip non-numeric matches,
+// as the numeric filters like gt do
+
+type sumAggregator struct {
+	sum float64
+}
+
+func (a *sumAggregator) add(match string) {
+	if num, ok := parseNumber(match); ok {
+		a.sum += num
+	}
+}
+
+func (a *sumAggregator) merge(other aggregator) {
+	a.sum += other.(*sumAggregator).sum
+}
+
+func (a *sumAggregator) fields(name string) [][]string {
+	return [][]string{{formatNumber(a.sum), name}}
+}
+
+type avgAggregator struct {
+	sum   float64
+	count int
+}
+
+func (a *avgAggregator) add(match string) {
+	if num, ok := parseNumber(match); ok {
+		a.sum += num
+		a.count++
+	}
+}
+
+func (a *avgAggregator) merge(other aggregator) {
+	o := other.(*avgAggregator)
+	a.sum += o.sum
+	a.count += o.count
+}
+
+func (a *avgAggregator) fields(name string) [][]string {
+	if a.count == 0 {
+		return [][]string{{"", name}}
+	}
+	return [][]string{{formatNumber(a.sum / float64(a.count)), name}}
+}
+
+type minAggregator struct {
+	min float64
+}
+
+func (a *minAggregator) add(match string) {
+	if num, ok := parseNumber(match); ok {
+		a.min = math.Min(a.min, num)
+	}
+}
+
+func (a *minAggregator) merge(other aggregator) {
+	a.min = math.Min(a.min, other.(*minAggregator).min)
+}
+
+func (a *minAggregator) fields(name string) [][]string {
+	if math.IsInf(a.min, 1) {
+		return [][]string{{"", name}}
+	}
+	return [][]string{{formatNumber(a.min), name}}
+}
+
+type maxAggregator struct {
+	max float64
+}
+
+func (a *maxAggregator) add(match string) {
+	if num, ok := parseNumber(match); ok {
+		a.max = math.Max(a.max, num)
+	}
+}
+
+func (a *maxAggregator) merge(other aggregator) {
+	a.max = math.Max(a.max, other.(*maxAggregator).max)
+}
+
+func (a *maxAggregator) fields(name string) [][]string {
+	if math.IsInf(a.max, -1) {
+		return [][]string{{"", name}}
+	}
+	return [][]string{{formatNumber(a.max), name}}
+}
+
+// parseNumbers parses a comma separated list of numbers
+// e.g. `50,95,99.9` -> [50, 95, 99.9]
+func parseNumbers(arg string) ([]float64, error) {
+	var nums []float64
+	for _, part := range strings.Split(arg, ",") {
+		num, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		nums = append(nums, num)
+	}
+	return nums, nil
+}
+
+// fieldSuffix turns a number into a valid field name suffix, as
+// json printer interprets dots in names as nested objects
+func fieldSuffix(num float64) string {
+	return strings.ReplaceAll(formatNumber(num), ".", "_")
+}
+
+// percentilesAggregator estimates percentiles using a t-digest,
+// keeping memory bounded regardless of the number of values
+type percentilesAggregator struct {
+	percentiles []float64
+	digest      *tdigest
+}
+
+func newPercentilesAggregator(arg string) aggregator {
+	percentiles, err := parseNumbers(arg)
+	if err != nil {
+		fatalf("`%s` is not a valid list of percentiles", arg)
+	}
+	for _, p := range percentiles {
+		if p <= 0 || p > 100 {
+			fatalf("percentile `%s` must be in (0, 100]", formatNumber(p))
+		}
+	}
+
+	return &percentilesAggregator{
+		percentiles: percentiles,
+		digest:      newTdigest(100),
+	}
+}
+
+func (a *percentilesAggregator) add(match string) {
+	if num, ok := parseNumber(match); ok {
+		a.digest.add(num)
+	}
+}
+
+func (a *percentilesAggregator) merge(other aggregator) {
+	a.digest.merge(other.(*percentilesAggregator).digest)
+}
+
+// fields returns a field per percentile, e.g. latency.p50, latency.p99_9
+func (a *percentilesAggregator) fields(name string) [][]string {
+	var fields [][]string
+	for _, p := range a.percentiles {
+		value := ""
+		if a.digest.count > 0 {
+			q := a.digest.quantile(p / 100)
+			value = formatNumber(math.Round(q*1000) / 1000)
+		}
+		fields = append(fields, []string{value, name + ".p" + fieldSuffix(p)})
+	}
+	return fields
+}
+
+// histogramAggregator counts values falling in buckets delimited by
+// the provided upper bounds. Values above the last bound are counted
+// in an additional overflow bucket
+type histogramAggregator struct {
+	bounds []float64
+	counts []int
+}
+
+func newHistogramAggregator(arg string) aggregator {
+	bounds, err := parseNumbers(arg)
+	if err != nil {
+		fatalf("`%s` is not a valid list of histogram buckets", arg)
+	}
+	if !slices.IsSorted(bounds) {
+		fatalf("histogram buckets `%s` must be sorted", arg)
+	}
+
+	return &histogramAggregator{
+		bounds: bounds,
+		counts: make([]int, len(bounds)+1),
+	}
+}
+
+func (a *histogramAggregator) add(match string) {
+	num, ok := parseNumber(match)
+	if !ok {
+		return
+	}
+	i, _ := slices.BinarySearch(a.bounds, num)
+	a.counts[i]++
+}
+
+func (a *histogramAggregator) merge(other aggregator) {
+	for i, count := range other.(*histogramAggregator).counts {
+		a.counts[i] += count
+	}
+}
+
+// fields returns a field per bucket, e.g. latency.le_100, latency.le_inf
+func (a *histogramAggregator) fields(name string) [][]string {
+	var fields [][]string
+	for i, count := range a.counts {
+		suffix := "inf"
+		if i < len(a.bounds) {
+			suffix = fieldSuffix(a.bounds[i])
+		}
+		fields = append(fields, []string{strconv.Itoa(count), name + ".le_" + suffix})
+	}
+	return fields
+}
+
+// topkAggregator finds the most frequent matches using a Space-Saving
+// sketch, keeping memory bounded regardless of the number of distinct matches
+type topkAggregator struct {
+	k      int
+	sketch *spaceSaving
+}
+
+// newTopkAggregator accepts the number of matches to print, optionally
+// followed by the number of counters of the sketch. More counters
+// mean tighter error bounds. e.g. `10` or `10/10000`
+func newTopkAggregator(arg string) aggregator {
+	parts := strings.Split(arg, "/")
+	k, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || k < 1 {
+		fatalf("`%s` is not a valid number of top matches", parts[0])
+	}
+
+	capacity := max(100, 10*k)
+	if len(parts) > 1 {
+		capacity, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || capacity < k {
+			fatalf("`%s` is not a valid number of counters, must be at least %d", parts[1], k)
+		}
+	}
+
+	return &topkAggregator{k: k, sketch: newSpaceSaving(capacity)}
+}
+
+func (a *topkAggregator) add(match string) {
+	a.sketch.add(match)
+}
+
+func (a *topkAggregator) merge(other aggregator) {
+	a.sketch.merge(other.(*topkAggregator).sketch)
+}
+
+// fields returns the key, count and error of each top match, e.g.
+// ips.0.key, ips.0.count, ips.0.error (an array with -format json).
+// The true count of a key is between count - error and count.
+// Groups with fewer than k distinct matches are padded with empty
+// fields, so that every group has the same csv columns
+func (a *topkAggregator) fields(name string) [][]string {
+	top := a.sketch.top(a.k)
+
+	var fields [][]string
+	for i := 0; i < a.k; i++ {
+		prefix := name + "." + strconv.Itoa(i)
+		key, count, errBound := "", "", ""
+		if i < len(top) {
+			key = top[i].key
+			count = strconv.FormatInt(top[i].count, 10)
+			errBound = strconv.FormatInt(top[i].err, 10)
+		}
+		fields = append(fields,
+			[]string{key, prefix + ".key"},
+			[]string{count, prefix + ".count"},
+			[]string{errBound, prefix + ".error"},
+		)
+	}
+	return fields
+}
+
+// distinctAggregator estimates the number of distinct matches
+type distinctAggregator struct {
+	hll *hyperLogLog
+}
+
+func (a *distinctAggregator) add(match string) {
+	a.hll.add(match)
+}
+
+func (a *distinctAggregator) merge(other aggregator) {
+	a.hll.merge(other.(*distinctAggregator).hll)
+}
+
+func (a *distinctAggregator) fields(name string) [][]string {
+	return [][]string{{strconv.FormatUint(a.hll.count(), 10), name}}
+}
@@ -0,0 +1,151 @@
+package patman
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resetAggregation aggregates the count of `n` and the sum of `lat`
+// in a fresh aggregation
+func resetAggregation(t *testing.T) *aggregation {
+	reset := func() {
+		aggregatePipelines = nil
+		groupBy, timeField = "", ""
+		windowSize, lateness = 0, 0
+		columns = nil
+	}
+	reset()
+	t.Cleanup(reset)
+
+	aggregatePipelines = []aggregatePipeline{
+		{name: "n", cmd: Command{Name: "count", Arg: "_"}},
+		{name: "lat", cmd: Command{Name: "sum", Arg: "_"}},
+	}
+	return newAggregation()
+}
+
+// collect returns a printer appending records to printed
+func collect(printed *[][][]string) printer {
+	return func(record [][]string) {
+		*printed = append(*printed, record)
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	t.Run("Should aggregate all records without groupby", func(t *testing.T) {
+		a := resetAggregation(t)
+
+		a.add([][]string{{"a", "n"}, {"10", "lat"}}, 0, nil)
+		a.add([][]string{{"b", "n"}, {"5", "lat"}}, 1, nil)
+
+		var printed [][][]string
+		a.flush(collect(&printed))
+		assert.Equal(t, [][][]string{{{"2", "n"}, {"15", "lat"}}}, printed)
+	})
+
+	t.Run("Should aggregate each groupby value in order of appearance", func(t *testing.T) {
+		a := resetAggregation(t)
+		groupBy = "ip"
+
+		a.add([][]string{{"10.0.0.2", "ip"}, {"a", "n"}, {"10", "lat"}}, 0, nil)
+		a.add([][]string{{"10.0.0.1", "ip"}, {"b", "n"}, {"5", "lat"}}, 1, nil)
+		a.add([][]string{{"10.0.0.2", "ip"}, {"c", "n"}, {"1", "lat"}}, 2, nil)
+		a.add([][]string{{"d", "n"}, {"7", "lat"}}, 3, nil)
+
+		var printed [][][]string
+		a.flush(collect(&printed))
+		assert.Equal(t, [][][]string{
+			{{"10.0.0.2", "ip"}, {"2", "n"}, {"11", "lat"}},
+			{{"10.0.0.1", "ip"}, {"1", "n"}, {"5", "lat"}},
+		}, printed)
+	})
+
+	t.Run("Should merge per worker aggregations", func(t *testing.T) {
+		a := resetAggregation(t)
+		groupBy = "ip"
+		b := newAggregation()
+
+		a.add([][]string{{"x", "ip"}, {"a", "n"}, {"1", "lat"}}, 2, nil)
+		b.add([][]string{{"y", "ip"}, {"b", "n"}, {"2", "lat"}}, 0, nil)
+		b.add([][]string{{"x", "ip"}, {"c", "n"}, {"3", "lat"}}, 1, nil)
+		a.merge(b)
+
+		var printed [][][]string
+		a.flush(collect(&printed))
+		assert.Equal(t, [][][]string{
+			{{"y", "ip"}, {"1", "n"}, {"2", "lat"}},
+			{{"x", "ip"}, {"2", "n"}, {"4", "lat"}},
+		}, printed)
+	})
+}
+
+func TestWindowedAggregation(t *testing.T) {
+	record := func(ts string) [][]string {
+		return [][]string{{ts, "ts"}, {"x", "n"}, {"1", "lat"}}
+	}
+	window := func(start, count string) [][]string {
+		return [][]string{{start, "window"}, {count, "n"}, {count, "lat"}}
+	}
+
+	t.Run("Should print windows once the watermark passes them", func(t *testing.T) {
+		a := resetAggregation(t)
+		timeField, windowSize = "ts", time.Minute
+
+		var printed [][][]string
+		a.add(record("2024-01-01T00:00:10Z"), 0, collect(&printed))
+		a.add(record("2024-01-01T00:00:50Z"), 1, collect(&printed))
+		assert.Empty(t, printed)
+
+		a.add(record("2024-01-01T00:01:05Z"), 2, collect(&printed))
+		assert.Equal(t, [][][]string{window("2024-01-01T00:00:00Z", "2")}, printed)
+
+		a.add(record("2024-01-01T00:00:30Z"), 3, collect(&printed))
+		a.add([][]string{{"x", "n"}}, 4, collect(&printed))
+		assert.Equal(t, 1, a.late)
+		assert.Equal(t, 1, a.untimed)
+
+		a.flush(collect(&printed))
+		assert.Equal(t, [][][]string{
+			window("2024-01-01T00:00:00Z", "2"),
+			window("2024-01-01T00:01:00Z", "1"),
+		}, printed)
+	})
+
+	t.Run("Should accept out of order records within lateness", func(t *testing.T) {
+		a := resetAggregation(t)
+		timeField, windowSize, lateness = "ts", time.Minute, 30*time.Second
+
+		var printed [][][]string
+		a.add(record("2024-01-01T00:00:10Z"), 0, collect(&printed))
+		a.add(record("2024-01-01T00:01:05Z"), 1, collect(&printed))
+		a.add(record("2024-01-01T00:00:40Z"), 2, collect(&printed))
+		assert.Empty(t, printed)
+
+		a.add(record("2024-01-01T00:01:40Z"), 3, collect(&printed))
+		assert.Equal(t, [][][]string{window("2024-01-01T00:00:00Z", "2")}, printed)
+		assert.Zero(t, a.late)
+	})
+
+}
+
+func TestTopkAggregation(t *testing.T) {
+	t.Run("Should print k matches for every group", func(t *testing.T) {
+		a := resetAggregation(t)
+		groupBy = "k"
+		aggregatePipelines = []aggregatePipeline{{name: "t", cmd: Command{Name: "topk", Arg: "2"}}}
+
+		a.add([][]string{{"a", "k"}, {"x", "t"}}, 0, nil)
+		a.add([][]string{{"a", "k"}, {"y", "t"}}, 1, nil)
+		a.add([][]string{{"a", "k"}, {"x", "t"}}, 2, nil)
+		a.add([][]string{{"b", "k"}, {"y", "t"}}, 3, nil)
+
+		var printed [][][]string
+		a.flush(collect(&printed))
+		assert.Equal(t, [][][]string{
+			{{"a", "k"}, {"x", "t.0.key"}, {"2", "t.0.count"}, {"0", "t.0.error"}, {"y", "t.1.key"}, {"1", "t.1.count"}, {"0", "t.1.error"}},
+			{{"b", "k"}, {"y", "t.0.key"}, {"1", "t.0.count"}, {"0", "t.0.error"}, {"", "t.1.key"}, {"", "t.1.count"}, {"", "t.1.error"}},
+		}, printed)
+	})
+}
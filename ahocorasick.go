@@ -0,0 +1,106 @@
+package patman
+
+// ahoCorasick is a multi-pattern substring matcher. Patterns are compiled
+// into a DFA over byte classes, so a lookup costs one table read per input
+// byte regardless of how many patterns are searched for.
+type ahoCorasick struct {
+	// classes maps every byte to a column of the transition table.
+	// Bytes not appearing in any pattern share class 0
+	classes [256]int32
+	stride  int32
+
+	// delta[state*stride+class] -> next state
+	delta []int32
+
+	// match[state] is true when reaching state completes at least one pattern
+	match []bool
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{stride: 1}
+
+	for _, pattern := range patterns {
+		for i := 0; i < len(pattern); i++ {
+			if ac.classes[pattern[i]] == 0 {
+				ac.classes[pattern[i]] = ac.stride
+				ac.stride++
+			}
+		}
+	}
+
+	newState := func() int32 {
+		for i := int32(0); i < ac.stride; i++ {
+			ac.delta = append(ac.delta, -1)
+		}
+		ac.match = append(ac.match, false)
+		return int32(len(ac.match) - 1)
+	}
+
+	// build trie
+	root := newState()
+	for _, pattern := range patterns {
+		state := root
+		for i := 0; i < len(pattern); i++ {
+			slot := state*ac.stride + ac.classes[pattern[i]]
+			if ac.delta[slot] < 0 {
+				// newState grows delta, assign only after it returns
+				next := newState()
+				ac.delta[slot] = next
+			}
+			state = ac.delta[slot]
+		}
+		ac.match[state] = true
+	}
+
+	// turn trie into a DFA by resolving failure links breadth first
+	fail := make([]int32, len(ac.match))
+	var queue []int32
+	for c := int32(0); c < ac.stride; c++ {
+		next := ac.delta[root*ac.stride+c]
+		if next < 0 {
+			ac.delta[root*ac.stride+c] = root
+			continue
+		}
+		fail[next] = root
+		queue = append(queue, next)
+	}
+
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		if ac.match[fail[state]] {
+			ac.match[state] = true
+		}
+
+		for c := int32(0); c < ac.stride; c++ {
+			next := ac.delta[state*ac.stride+c]
+			fallback := ac.delta[fail[state]*ac.stride+c]
+			if next < 0 {
+				ac.delta[state*ac.stride+c] = fallback
+				continue
+			}
+			fail[next] = fallback
+			queue = append(queue, next)
+		}
+	}
+
+	return ac
+}
+
+// contains reports whether s contains at least one of the patterns
+func (ac *ahoCorasick) contains(s string) bool {
+	var state int32
+	if ac.match[state] {
+		return true
+	}
+
+	for i := 0; i < len(s); i++ {
+		state = ac.delta[state*ac.stride+ac.classes[s[i]]]
+		if ac.match[state] {
+			return true
+		}
+	}
+
+	return false
+}
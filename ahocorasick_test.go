@@ -0,0 +1,51 @@
+package patman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAhoCorasick(t *testing.T) {
+	t.Run("Should find any of the patterns", func(t *testing.T) {
+		ac := newAhoCorasick([]string{"he", "she", "his", "hers"})
+
+		assert.True(t, ac.contains("ushers"))
+		assert.True(t, ac.contains("this"))
+		assert.True(t, ac.contains("he"))
+		assert.False(t, ac.contains("hi"))
+		assert.False(t, ac.contains("sh"))
+		assert.False(t, ac.contains(""))
+	})
+
+	t.Run("Should follow failure links across overlapping patterns", func(t *testing.T) {
+		ac := newAhoCorasick([]string{"abcd", "bce"})
+
+		assert.True(t, ac.contains("xxabcexx"))
+		assert.False(t, ac.contains("abcabc"))
+	})
+
+	t.Run("Should match everything with an empty pattern", func(t *testing.T) {
+		ac := newAhoCorasick([]string{""})
+
+		assert.True(t, ac.contains(""))
+		assert.True(t, ac.contains("anything"))
+	})
+
+	t.Run("Should match nothing without patterns", func(t *testing.T) {
+		ac := newAhoCorasick(nil)
+
+		assert.False(t, ac.contains("anything"))
+	})
+
+	t.Run("Should handle many patterns", func(t *testing.T) {
+		var ids []string
+		for i := 0; i < 500; i++ {
+			ids = append(ids, "req-"+string(rune('a'+i%26))+string(rune('a'+i/26)))
+		}
+		ac := newAhoCorasick(ids)
+
+		assert.True(t, ac.contains("GET /api req-ka 200"))
+		assert.False(t, ac.contains("GET /api req-0 200"))
+	})
+}
@@ -1,35 +1,207 @@
 package patman
 
-// [index] => [match, name][]
-var state = map[string][][]string{}
+import (
+	"container/list"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// group holds the records collected so far for an index value
+type group struct {
+	key string
+
+	// [match, name] of each index pipeline
+	index [][]string
+
+	// [match, name][], at most one per pipeline name
+	// unless -index-multi is set
+	results [][]string
+
+	// line and time of the last update, used to expire idle groups
+	line    int64
+	updated time.Time
+
+	elem *list.Element
+}
+
+// [index] => group
+var state = map[string]*group{}
+
+// indexNames holds the pipeline names composing the index.
+// e.g. `-index trace_id,span_id` -> [trace_id, span_id]
+var indexNames []string
+
+func isIndex(name string) bool {
+	return slices.Contains(indexNames, name)
+}
+
+// recency orders groups from least to most recently updated
+var recency = list.New()
+
+// lines counts the records seen by buffer, used as clock for -index-timeout
+var lines int64
+
+var indexTimeoutLines int64
+var indexTimeoutDuration time.Duration
+
+// parseIndexTimeout accepts either a number of lines or a duration
+// e.g. `10000` or `30s`
+func parseIndexTimeout(timeout string) {
+	if timeout == "" {
+		return
+	}
+
+	if n, err := strconv.ParseInt(timeout, 10, 64); err == nil && n > 0 {
+		indexTimeoutLines = n
+		return
+	}
+
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d <= 0 {
+		fatalf("`%s` is not a valid index timeout, expected a number of lines or a duration", timeout)
+	}
+	indexTimeoutDuration = d
+}
 
 // buffer let flows all streamed records until
 // they complete on matching pipelines based
-// on a common index
-func buffer(results [][]string) [][]string {
-	var matchingIndex string
+// on a common index. Returns the groups ready to be printed:
+// completed ones, plus incomplete ones expired or evicted
+// according to -index-timeout and -index-max-keys.
+func buffer(results [][]string) [][][]string {
+	lines++
+	now := time.Now()
+
+	ready := expire(now)
 
+	// composite indexes match only when all their pipelines match
+	keys := make([][]string, len(indexNames))
 	for _, result := range results {
-		match, name := result[0], result[1]
+		if i := slices.Index(indexNames, result[1]); i >= 0 {
+			keys[i] = result
+		}
+	}
 
-		if name == index {
-			matchingIndex = match
+	var values []string
+	for _, key := range keys {
+		if key == nil || key[0] == "" {
+			return ready
 		}
+		values = append(values, key[0])
 	}
+	matchingIndex := strings.Join(values, "\x00")
 
-	if matchingIndex == "" {
-		return nil
+	g, ok := state[matchingIndex]
+	if !ok {
+		g = &group{key: matchingIndex, index: keys}
+		g.elem = recency.PushBack(g)
+		state[matchingIndex] = g
+	} else {
+		recency.MoveToBack(g.elem)
 	}
+	g.line = lines
+	g.updated = now
 
 	for _, result := range results {
-		if result[1] != index {
-			state[matchingIndex] = append(state[matchingIndex], result)
+		if !isIndex(result[1]) {
+			g.add(result)
 		}
 	}
 
-	if len(state[matchingIndex]) == len(pipelineNames)-1 {
-		return append([][]string{{matchingIndex, index}}, state[matchingIndex]...)
+	// with -index-multi more records may always come for
+	// the same index, so groups are never complete
+	if !indexMulti && len(g.results) == len(pipelineNames)-len(indexNames) {
+		remove(g)
+		return append(ready, g.emit())
+	}
+
+	for indexMaxKeys > 0 && len(state) > indexMaxKeys {
+		oldest := recency.Front().Value.(*group)
+		remove(oldest)
+		ready = append(ready, oldest.emit())
+	}
+
+	return ready
+}
+
+// flushBuffer empties the buffer once input ends,
+// returning all incomplete groups
+func flushBuffer() [][][]string {
+	var ready [][][]string
+	for recency.Len() > 0 {
+		g := recency.Front().Value.(*group)
+		remove(g)
+		ready = append(ready, g.emit())
+	}
+	return ready
+}
+
+// expire removes groups idle for longer than -index-timeout
+func expire(now time.Time) [][][]string {
+	if indexTimeoutLines == 0 && indexTimeoutDuration == 0 {
+		return nil
+	}
+
+	var ready [][][]string
+	for recency.Len() > 0 {
+		g := recency.Front().Value.(*group)
+		if indexTimeoutLines > 0 && lines-g.line <= indexTimeoutLines {
+			break
+		}
+		if indexTimeoutDuration > 0 && now.Sub(g.updated) <= indexTimeoutDuration {
+			break
+		}
+		remove(g)
+		ready = append(ready, g.emit())
+	}
+	return ready
+}
+
+func remove(g *group) {
+	recency.Remove(g.elem)
+	delete(state, g.key)
+}
+
+// add stores result in g, replacing any previous result of the same pipeline
+// unless -index-multi is set
+func (g *group) add(result []string) {
+	if indexMulti {
+		g.results = append(g.results, result)
+		return
+	}
+
+	for i, r := range g.results {
+		if r[1] == result[1] {
+			g.results[i] = result
+			return
+		}
+	}
+	g.results = append(g.results, result)
+}
+
+// emit returns the records of g prefixed by the index. Pipelines
+// without records are filled with -index-marker
+func (g *group) emit() [][]string {
+	records := g.results
+	for _, name := range pipelineNames {
+		if isIndex(name) {
+			continue
+		}
+
+		found := false
+		for _, r := range g.results {
+			if r[1] == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			records = append(records, []string{indexMarker, name})
+		}
 	}
+	sortPipelines(records)
 
-	return nil
+	return append(slices.Clone(g.index), records...)
 }
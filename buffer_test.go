@@ -0,0 +1,138 @@
+package patman
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resetBuffer indexes records by indexes, among the pipelines names
+func resetBuffer(t *testing.T, names, indexes []string) {
+	reset := func() {
+		state = map[string]*group{}
+		recency = list.New()
+		lines = 0
+		pipelineNames, indexNames = nil, nil
+		indexTimeoutLines, indexTimeoutDuration = 0, 0
+		indexMaxKeys, indexMarker, indexMulti = 0, "", false
+	}
+	reset()
+	t.Cleanup(reset)
+
+	pipelineNames, indexNames = names, indexes
+}
+
+func TestBuffer(t *testing.T) {
+	t.Run("Should print and forget complete groups", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a", "b"}, []string{"id"})
+
+		assert.Empty(t, buffer([][]string{{"1", "id"}, {"x", "a"}}))
+		assert.Len(t, state, 1)
+
+		ready := buffer([][]string{{"y", "b"}, {"1", "id"}})
+		assert.Equal(t, [][][]string{{{"1", "id"}, {"x", "a"}, {"y", "b"}}}, ready)
+		assert.Empty(t, state)
+		assert.Zero(t, recency.Len())
+	})
+
+	t.Run("Should ignore records without index", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a", "b"}, []string{"id"})
+
+		assert.Empty(t, buffer([][]string{{"x", "a"}}))
+		assert.Empty(t, state)
+	})
+
+	t.Run("Should expire groups idle for a number of lines", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a", "b"}, []string{"id"})
+		indexTimeoutLines = 2
+		indexMarker = "-"
+
+		assert.Empty(t, buffer([][]string{{"1", "id"}, {"x", "a"}}))
+		assert.Empty(t, buffer([][]string{{"2", "id"}, {"y", "a"}}))
+		assert.Empty(t, buffer([][]string{{"3", "id"}, {"z", "a"}}))
+
+		ready := buffer([][]string{{"4", "id"}, {"w", "a"}})
+		assert.Equal(t, [][][]string{{{"1", "id"}, {"x", "a"}, {"-", "b"}}}, ready)
+		assert.Len(t, state, 3)
+	})
+
+	t.Run("Should expire groups idle for a duration", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a", "b"}, []string{"id"})
+		indexTimeoutDuration = time.Minute
+
+		buffer([][]string{{"1", "id"}, {"x", "a"}})
+		assert.Empty(t, expire(time.Now()))
+
+		ready := expire(time.Now().Add(2 * time.Minute))
+		assert.Equal(t, [][][]string{{{"1", "id"}, {"x", "a"}, {"", "b"}}}, ready)
+		assert.Empty(t, state)
+	})
+
+	t.Run("Should evict the least recently updated group", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a", "b"}, []string{"id"})
+		indexMaxKeys = 2
+
+		buffer([][]string{{"1", "id"}, {"x", "a"}})
+		buffer([][]string{{"2", "id"}, {"y", "a"}})
+		buffer([][]string{{"1", "id"}, {"z", "a"}})
+
+		ready := buffer([][]string{{"3", "id"}, {"w", "a"}})
+		assert.Equal(t, [][][]string{{{"2", "id"}, {"y", "a"}, {"", "b"}}}, ready)
+		assert.Len(t, state, 2)
+	})
+
+	t.Run("Should flush incomplete groups with marker once input ends", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a", "b"}, []string{"id"})
+		indexMarker = "n/a"
+
+		buffer([][]string{{"1", "id"}, {"x", "a"}})
+		buffer([][]string{{"2", "id"}, {"y", "b"}})
+
+		assert.Equal(t, [][][]string{
+			{{"1", "id"}, {"x", "a"}, {"n/a", "b"}},
+			{{"2", "id"}, {"n/a", "a"}, {"y", "b"}},
+		}, flushBuffer())
+		assert.Empty(t, state)
+		assert.Empty(t, flushBuffer())
+	})
+
+	t.Run("Should group by all pipelines of a composite index", func(t *testing.T) {
+		resetBuffer(t, []string{"trace", "span", "a", "b"}, []string{"trace", "span"})
+
+		assert.Empty(t, buffer([][]string{{"t1", "trace"}, {"x", "a"}}))
+		assert.Empty(t, state)
+
+		assert.Empty(t, buffer([][]string{{"t1", "trace"}, {"s1", "span"}, {"x", "a"}}))
+		assert.Empty(t, buffer([][]string{{"t1", "trace"}, {"s2", "span"}, {"y", "a"}}))
+		assert.Len(t, state, 2)
+
+		ready := buffer([][]string{{"t1", "trace"}, {"s2", "span"}, {"z", "b"}})
+		assert.Equal(t, [][][]string{{{"t1", "trace"}, {"s2", "span"}, {"y", "a"}, {"z", "b"}}}, ready)
+	})
+
+	t.Run("Should collect repeated pipelines with -index-multi", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a", "b"}, []string{"id"})
+		indexMulti = true
+
+		buffer([][]string{{"1", "id"}, {"x", "a"}})
+		buffer([][]string{{"1", "id"}, {"y", "b"}})
+		assert.Empty(t, buffer([][]string{{"1", "id"}, {"z", "a"}}))
+
+		assert.Equal(t, [][][]string{
+			{{"1", "id"}, {"x", "a"}, {"z", "a"}, {"y", "b"}},
+		}, flushBuffer())
+	})
+
+	t.Run("Should reject csv with -index-multi", func(t *testing.T) {
+		_, status := runPatman(t, "id=1 a=x\nid=1 a=y\n", "-index", "id", "-index-multi", "-format", "csv",
+			"m(id=\\d+) |> name(id)", "m(a=\\w) |> name(a)")
+		assert.Equal(t, exitError, status)
+
+		out, status := runPatman(t, "id=1 a=x\nid=1 a=y\n", "-index", "id", "-index-multi", "-format", "json",
+			"m(id=\\d+) |> name(id)", "m(a=\\w) |> name(a)")
+		assert.Equal(t, 0, status)
+		assert.JSONEq(t, `{"id":"id=1","a":["a=x","a=y"]}`, out)
+	})
+}
@@ -0,0 +1,155 @@
+package patman
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+)
+
+// base64Encodings maps the alphabets accepted by b64enc and b64dec
+var base64Encodings = map[string]*base64.Encoding{
+	"_":   base64.StdEncoding,
+	"std": base64.StdEncoding,
+	"url": base64.URLEncoding,
+}
+
+func base64Encoding(op, arg string) (*base64.Encoding, error) {
+	encoding, ok := base64Encodings[strings.TrimSpace(arg)]
+	if !ok {
+		return nil, fmt.Errorf("`%s` is not a valid alphabet for %s operator, expected std or url", arg, op)
+	}
+	return encoding, nil
+}
+
+func handleBase64Encode(line, arg string) (string, error) {
+	encoding, err := base64Encoding("b64enc", arg)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString([]byte(line)), nil
+}
+
+// handleBase64Decode decodes base64, with or without padding
+func handleBase64Decode(line, arg string) (string, error) {
+	encoding, err := base64Encoding("b64dec", arg)
+	if err != nil {
+		return "", err
+	}
+
+	decoded, err := encoding.WithPadding(base64.NoPadding).DecodeString(strings.TrimRight(strings.TrimSpace(line), "="))
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %w", err)
+	}
+	return string(decoded), nil
+}
+
+func handleHexEncode(line, arg string) (string, error) {
+	return hex.EncodeToString([]byte(line)), nil
+}
+
+func handleHexDecode(line, arg string) (string, error) {
+	decoded, err := hex.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return "", fmt.Errorf("invalid hex: %w", err)
+	}
+	return string(decoded), nil
+}
+
+// handleURLEncode escapes a line to be used as a query
+// parameter (default) or a path segment. e.g. `urlenc(_)`, `urlenc(path)`
+func handleURLEncode(line, arg string) (string, error) {
+	switch strings.TrimSpace(arg) {
+	case "_", "query":
+		return url.QueryEscape(line), nil
+	case "path":
+		return url.PathEscape(line), nil
+	}
+	return "", fmt.Errorf("`%s` is not a valid mode for urlenc operator, expected query or path", arg)
+}
+
+// handleURLDecode unescapes query parameters (default), where `+`
+// is a space, or path segments. e.g. `urldec(_)`, `urldec(path)`
+func handleURLDecode(line, arg string) (string, error) {
+	var decoded string
+	var err error
+	switch strings.TrimSpace(arg) {
+	case "_", "query":
+		decoded, err = url.QueryUnescape(line)
+	case "path":
+		decoded, err = url.PathUnescape(line)
+	default:
+		return "", fmt.Errorf("`%s` is not a valid mode for urldec operator, expected query or path", arg)
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid url encoding: %w", err)
+	}
+	return decoded, nil
+}
+
+// handleJSONUnescape unescapes a JSON string, quoted or not.
+// e.g. `{\"a\":\"b\\n\"}` -> `{"a":"b\n"}`
+func handleJSONUnescape(line, arg string) (string, error) {
+	quoted := strings.TrimSpace(line)
+	if len(quoted) < 2 || quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
+		quoted = `"` + quoted + `"`
+	}
+
+	var unescaped string
+	if err := json.Unmarshal([]byte(quoted), &unescaped); err != nil {
+		return "", fmt.Errorf("invalid json string: %w", err)
+	}
+	return unescaped, nil
+}
+
+func handleHTMLUnescape(line, arg string) (string, error) {
+	return html.UnescapeString(line), nil
+}
+
+// handleJWT decodes the header and claims of a JWT, without verifying
+// its signature. Returns the header, the claims or, with `_`, both
+// as {"header": ..., "claims": ...}. e.g. `jwt(claims)`
+func handleJWT(line, arg string) (string, error) {
+	if line == "" {
+		return "", nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(line), "Bearer "), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid jwt: expected 3 parts, got %d", len(parts))
+	}
+
+	decode := func(part, name string) (json.RawMessage, error) {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt %s: %w", name, err)
+		}
+		if !json.Valid(decoded) {
+			return nil, fmt.Errorf("invalid jwt %s: not json", name)
+		}
+		return decoded, nil
+	}
+
+	header, err := decode(parts[0], "header")
+	if err != nil {
+		return "", err
+	}
+	claims, err := decode(parts[1], "claims")
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.TrimSpace(arg) {
+	case "header":
+		return string(header), nil
+	case "claims":
+		return string(claims), nil
+	case "_":
+		both, err := json.Marshal(map[string]json.RawMessage{"header": header, "claims": claims})
+		return string(both), err
+	}
+	return "", fmt.Errorf("`%s` is not a valid part for jwt operator, expected header, claims or _", arg)
+}
@@ -0,0 +1,75 @@
+package patman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	t.Run("Should encode and decode", func(t *testing.T) {
+		cases := []struct {
+			op       operator
+			line     string
+			arg      string
+			expected string
+		}{
+			{handleBase64Encode, "hello?", "_", "aGVsbG8/"},
+			{handleBase64Encode, "hello?", "url", "aGVsbG8_"},
+			{handleBase64Decode, "aGVsbG8=", "std", "hello"},
+			{handleBase64Decode, "aGVsbG8", "_", "hello"},
+			{handleHexEncode, "hi", "_", "6869"},
+			{handleHexDecode, "6869", "_", "hi"},
+			{handleURLEncode, "a b&c", "_", "a+b%26c"},
+			{handleURLEncode, "a b", "path", "a%20b"},
+			{handleURLDecode, "a+b%26c", "_", "a b&c"},
+			{handleJSONUnescape, `{\"a\":\"b\\n\"}`, "_", "{\"a\":\"b\\n\"}"},
+			{handleJSONUnescape, `"tab\there"`, "_", "tab\there"},
+			{handleHTMLUnescape, "&lt;b&gt; &amp; &#39;", "_", "<b> & '"},
+		}
+		for _, c := range cases {
+			out, err := c.op(c.line, c.arg)
+			assert.NoError(t, err, c.line)
+			assert.Equal(t, c.expected, out, c.line)
+		}
+	})
+
+	t.Run("Should decode jwt without verifying", func(t *testing.T) {
+		token := "Bearer eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJzdWIiOiI0MiJ9.signature"
+
+		claims, err := handleJWT(token, "claims")
+		assert.NoError(t, err)
+		assert.Equal(t, `{"sub":"42"}`, claims)
+
+		both, err := handleJWT(token, "_")
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"header":{"alg":"HS256","typ":"JWT"},"claims":{"sub":"42"}}`, both)
+	})
+
+	t.Run("Should skip lines without a token", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, `m(Bearer \S+) |> jwt(claims) |> name(claims)`),
+		})
+
+		results, errs := p.eval("GET / 200")
+		assert.Empty(t, errs)
+		assert.Empty(t, results)
+
+		results, errs = p.eval("GET / Bearer eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJzdWIiOiI0MiJ9.signature")
+		assert.Empty(t, errs)
+		assert.Equal(t, [][]string{{`{"sub":"42"}`, "claims"}}, results)
+	})
+
+	t.Run("Should error on invalid input", func(t *testing.T) {
+		_, err := handleBase64Decode("not base64!", "_")
+		assert.Error(t, err)
+		_, err = handleHexDecode("zz", "_")
+		assert.Error(t, err)
+		_, err = handleURLDecode("%zz", "_")
+		assert.Error(t, err)
+		_, err = handleJWT("a.b", "claims")
+		assert.Error(t, err)
+		_, err = handleBase64Encode("a", "nope")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,113 @@
+package patman
+
+var contextBefore int
+var contextAfter int
+
+// contextSeparator is printed between non contiguous groups of lines
+const contextSeparator = "--"
+
+// setupContext validates the -A, -B and -C options. Context lines are
+// printed as they are read, so they only make sense for plain output
+// printed in input order
+func setupContext(around int) {
+	if around > 0 {
+		contextBefore = max(contextBefore, around)
+		contextAfter = max(contextAfter, around)
+	}
+	if contextBefore < 0 || contextAfter < 0 {
+		fatalf("context must be a positive number of lines")
+	}
+	if !withContext() {
+		return
+	}
+
+	switch {
+	case format != "stdout" || joinDelimiter != "":
+		fatalf("-A, -B and -C are only supported with -format stdout")
+	case index != "" || aggregating() || sorting() || uniqCount || countMatches:
+		fatalf("-A, -B and -C cannot be used with -index, aggregates, sort, -uniq-count or -count")
+	case unordered:
+		fatalf("-A, -B and -C cannot be used with -unordered, as context depends on input order")
+	}
+}
+
+func withContext() bool {
+	return contextBefore > 0 || contextAfter > 0
+}
+
+type contextLine struct {
+	seq    int64
+	record [][]string
+}
+
+// before is a ring buffer of the last -B lines not printed
+var before []contextLine
+var beforeStart int
+
+// afterLeft is the number of lines still to be printed after the last match
+var afterLeft int
+
+// lastPrinted is the position of the last printed line, -1 when none
+var lastPrinted int64 = -1
+
+// contextSeq is the position of the current line
+var contextSeq int64
+
+// printWithContext prints the results of a line along with -B lines
+// before and -A lines after it, like grep does. Lines without results
+// are printed unmodified, as their raw record, when in context of
+// a matching line
+func printWithContext(raw, results [][]string, print printer) {
+	seq := contextSeq
+	contextSeq++
+
+	if len(results) == 0 {
+		if afterLeft > 0 {
+			afterLeft--
+			print(raw)
+			lastPrinted = seq
+			return
+		}
+		if contextBefore > 0 {
+			pushBefore(contextLine{seq: seq, record: raw})
+		}
+		return
+	}
+
+	first := seq
+	if len(before) > 0 {
+		first = before[beforeStart].seq
+	}
+	if lastPrinted >= 0 && first > lastPrinted+1 {
+		print([][]string{{contextSeparator, ""}})
+	}
+
+	for i := range before {
+		print(before[(beforeStart+i)%len(before)].record)
+	}
+	before = before[:0]
+	beforeStart = 0
+
+	print(results)
+	lastPrinted = seq
+	afterLeft = contextAfter
+}
+
+// skipContext accounts for a line dropped before printing, e.g. out of
+// -since and -until. Lines around it are no longer contiguous, so it ends
+// the context after the last match and drops the one before the next
+func skipContext() {
+	contextSeq++
+	afterLeft = 0
+	before = before[:0]
+	beforeStart = 0
+}
+
+func pushBefore(l contextLine) {
+	if len(before) < contextBefore {
+		before = append(before, l)
+		return
+	}
+	before[beforeStart] = l
+	beforeStart = (beforeStart + 1) % len(before)
+}
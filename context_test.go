@@ -0,0 +1,55 @@
+package patman
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintWithContext(t *testing.T) {
+	contextBefore, contextAfter = 1, 1
+	defer func() {
+		contextBefore, contextAfter = 0, 0
+		before, beforeStart, afterLeft, lastPrinted, contextSeq = nil, 0, 0, -1, 0
+	}()
+
+	t.Run("Should print lines around matches with separators", func(t *testing.T) {
+		var printed []string
+		print := func(record [][]string) {
+			printed = append(printed, record[0][0])
+		}
+
+		for i := 1; i <= 10; i++ {
+			line := strconv.Itoa(i)
+			var results [][]string
+			if i == 3 || i == 4 || i == 8 {
+				results = [][]string{{"match " + line, ""}}
+			}
+			printWithContext([][]string{{line, ""}}, results, print)
+		}
+
+		assert.Equal(t, []string{"2", "match 3", "match 4", "5", "--", "7", "match 8", "9"}, printed)
+	})
+}
+
+func TestContextEndToEnd(t *testing.T) {
+	t.Run("Should separate groups around lines out of -since", func(t *testing.T) {
+		input := "2024-01-05 ERR a\n2024-01-01 ERR old\nok\n2024-01-07 ERR b\n"
+		for _, workers := range []string{"1", "4"} {
+			out, status := runPatman(t, input, "-workers", workers, "-C", "1", "-since", "2024-01-02",
+				"-time-field", "ts", "ml(ERR) |> split( /0) |> name(ts)")
+			assert.Equal(t, 0, status)
+			assert.Equal(t, "2024-01-05\n--\n2024-01-07\n", out)
+		}
+	})
+
+	t.Run("Should print context after the last match of -max-count", func(t *testing.T) {
+		input := "ERR 1\nERR 2\nok 3\nok 4\nERR 5\nok 6\n"
+		for _, workers := range []string{"1", "4"} {
+			out, status := runPatman(t, input, "-workers", workers, "-max-count", "1", "-A", "2", "ml(ERR)")
+			assert.Equal(t, 0, status)
+			assert.Equal(t, "ERR 1\nERR 2\nok 3\n", out)
+		}
+	})
+}
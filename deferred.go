@@ -0,0 +1,61 @@
+package patman
+
+// deferredStage holds back the lines reaching a stage,
+// printing them as records once input ends
+type deferredStage interface {
+	// records returns the records printed for a pipeline named name
+	records(name string) [][][]string
+}
+
+// deferredStages holds the deferred stages of the compiled plan, in pipelines order
+var deferredStages []deferredStage
+
+// deferredPipelines holds the names of the pipelines ending with a deferred stage
+var deferredPipelines []string
+
+// isDeferred reports whether cmd holds back lines until input ends
+func isDeferred(cmd Command) bool {
+	switch canonical(cmd.Name) {
+	case "tail", "reservoir":
+		return true
+	case "uniq", "uniqby":
+		return uniqCount
+	}
+	return false
+}
+
+// setupDeferred finds the pipelines ending with a deferred stage. Deferred
+// stages must be the last of a pipeline, as their lines are printed
+// as they are once input ends
+func setupDeferred() {
+	for _, cmds := range pipelines {
+		var name string
+		last := len(cmds) - 1
+		if cmds[last].Name == "name" {
+			name = cmds[last].Arg
+			last--
+		}
+
+		for i, cmd := range cmds {
+			if !isDeferred(cmd) {
+				continue
+			}
+			if i != last {
+				fatalf("`%s` must be the last operator of a pipeline, as it prints lines once input ends", cmd.Name)
+			}
+			if name != "" && name == timeField {
+				fatalf("pipeline `%s` ending with `%s` cannot be used as -time-field", name, cmd.Name)
+			}
+			deferredPipelines = append(deferredPipelines, name)
+		}
+	}
+}
+
+// flushDeferred prints the records of deferred stages once input ends
+func flushDeferred(print printer) {
+	for i, stage := range deferredStages {
+		for _, record := range stage.records(deferredPipelines[i]) {
+			output(record, print)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package patman
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	onErrorFail        = "fail"
+	onErrorSkip        = "skip"
+	onErrorLog         = "log"
+	onErrorPassthrough = "passthrough"
+)
+
+// pipelineError is an operator error annotated with the pipeline
+// and the stage it happened in
+type pipelineError struct {
+	Pipeline int
+	Stage    Command
+	Err      error
+}
+
+// errorRecord is the JSON line written to -errors-file for every failed pipeline
+type errorRecord struct {
+	Line       string `json:"line"`
+	LineNumber int64  `json:"line_number"`
+	Pipeline   int    `json:"pipeline"`
+	Stage      string `json:"stage"`
+	Arg        string `json:"arg"`
+	Error      string `json:"error"`
+}
+
+// errorsMu guards the errors file, as workers
+// may exit while the collector is writing to it
+var errorsMu sync.Mutex
+var errorsWriter *bufio.Writer
+var errorsEncoder *json.Encoder
+var errorsFile *os.File
+
+func openErrorsFile(path string) {
+	var err error
+	errorsFile, err = os.Create(path)
+	if err != nil {
+		fatalf("failed to open errors file: %v", err)
+	}
+	errorsWriter = bufio.NewWriter(errorsFile)
+	errorsEncoder = json.NewEncoder(errorsWriter)
+}
+
+func closeErrorsFile() {
+	errorsMu.Lock()
+	defer errorsMu.Unlock()
+	if errorsFile == nil {
+		return
+	}
+	errorsWriter.Flush()
+	errorsFile.Close()
+	errorsFile, errorsWriter, errorsEncoder = nil, nil, nil
+}
+
+// handleErrors applies the -on-error policy to the errors raised while
+// processing a line. seq is the 0-based position of the line in input.
+// Must be called from a single goroutine, in input order when possible
+func handleErrors(seq int64, line string, errs []pipelineError) {
+	for _, e := range errs {
+		errorsMu.Lock()
+		if errorsEncoder != nil {
+			errorsEncoder.Encode(errorRecord{
+				Line:       line,
+				LineNumber: seq + 1,
+				Pipeline:   e.Pipeline,
+				Stage:      e.Stage.Name,
+				Arg:        e.Stage.Arg,
+				Error:      e.Err.Error(),
+			})
+		}
+		errorsMu.Unlock()
+
+		switch onError {
+		case onErrorFail:
+			fatalf("error processing line %d (pipeline %d, stage %s): %v", seq+1, e.Pipeline, e.Stage.Name, e.Err)
+		case onErrorLog:
+			log.Printf("error processing line %d (pipeline %d, stage %s): %v", seq+1, e.Pipeline, e.Stage.Name, e.Err)
+		}
+	}
+}
+
+// Exit statuses, mirroring grep
+const (
+	exitNoMatch = 1
+	exitError   = 2
+)
+
+// fatalf logs an error and exits with exitError, as
+// exiting with 1 means that no line matched
+func fatalf(format string, v ...any) {
+	log.Printf(format, v...)
+	exit(exitError)
+}
+
+// exit is the single way out of a run. It flushes
+// -errors-file so that errors recorded so far are kept
+func exit(status int) {
+	closeErrorsFile()
+	os.Exit(status)
+}
@@ -0,0 +1,82 @@
+package patman
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Reserved field names, describing where a record was read from
+const (
+	lineField   = "__line"
+	offsetField = "__offset"
+	fileField   = "__file"
+)
+
+var lineNumbers bool
+var byteOffsets bool
+
+// reservedFields holds the reserved fields added to each record, in order
+var reservedFields []string
+
+// setupFields enables the reserved fields requested by -n and -byte-offset,
+// or referenced by a custom -format
+func setupFields() {
+	custom := true
+	for name := range printers {
+		if name == format {
+			custom = false
+		}
+	}
+
+	enabled := map[string]bool{
+		lineField:   lineNumbers,
+		offsetField: byteOffsets,
+		fileField:   (lineNumbers || byteOffsets) && input != "",
+	}
+	for _, name := range []string{lineField, offsetField, fileField} {
+		if custom && strings.Contains(format, "%"+name) {
+			enabled[name] = true
+		}
+		if enabled[name] {
+			reservedFields = append(reservedFields, name)
+		}
+	}
+
+	if len(reservedFields) == 0 {
+		return
+	}
+	if index != "" || aggregating() || uniqCount {
+		fatalf("-n and -byte-offset cannot be used with -index, aggregates or -uniq-count")
+	}
+	if format == "csv" {
+		columns = append(append(columns, reservedFields...), pipelineNames...)
+	}
+}
+
+// withFields prepends the reserved fields of the line at
+// position seq and byte offset to a record
+func withFields(record [][]string, seq, offset int64) [][]string {
+	if len(reservedFields) == 0 || len(record) == 0 {
+		return record
+	}
+
+	fields := make([][]string, 0, len(reservedFields)+len(record))
+	for _, name := range reservedFields {
+		switch name {
+		case lineField:
+			fields = append(fields, []string{strconv.FormatInt(seq+1, 10), name})
+		case offsetField:
+			fields = append(fields, []string{strconv.FormatInt(offset, 10), name})
+		case fileField:
+			fields = append(fields, []string{inputName(), name})
+		}
+	}
+	return append(fields, record...)
+}
+
+func inputName() string {
+	if input == "" {
+		return "(standard input)"
+	}
+	return input
+}
@@ -0,0 +1,76 @@
+package patman
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hash64 hashes s, mixing the bits of FNV-1a so that
+// every bit of the result is evenly distributed
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	// splitmix64 finalizer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// hllPrecision is the number of hash bits selecting a register.
+// 2^14 registers estimate cardinalities with ~0.8% standard error in 16KB
+const hllPrecision = 14
+
+// hyperLogLog estimates the number of distinct values of a stream
+// (Flajolet et al., "HyperLogLog: the analysis of a near-optimal
+// cardinality estimation algorithm"). Each register keeps the longest
+// run of leading zeros seen among the hashes routed to it.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) add(value string) {
+	x := hash64(value)
+	register := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	h.registers[register] = max(h.registers[register], rank)
+}
+
+// merge adds the values seen by other, as if they were added to h
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other.registers {
+		h.registers[i] = max(h.registers[i], rank)
+	}
+}
+
+func (h *hyperLogLog) count() uint64 {
+	m := float64(len(h.registers))
+
+	var sum float64
+	var zeros int
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+
+	// linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(math.Round(estimate))
+}
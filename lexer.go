@@ -78,7 +78,8 @@ func (l *lexer) NextToken() token {
 	// OPERATOR
 	if l.isPrevPipe() || l.pos == 0 || l.isPrevWhitespace() {
 		identIndex := l.pos
-		for l.isAlpha() {
+		// digits are allowed after the first character, e.g. b64enc
+		for l.isAlpha() || (identIndex != l.pos && l.isDigit()) {
 			l.next()
 		}
 
@@ -93,7 +94,8 @@ func (l *lexer) NextToken() token {
 		}
 	}
 
-	if l.isLparens() {
+	// Arguments can start with a parenthesis, e.g. calc((x - 32) / 1.8)
+	if l.isLparens() && !l.isPrevLparens() {
 		l.next()
 		return token{
 			Type:  L_PARENS,
@@ -270,8 +272,12 @@ func (l *lexer) isBackSlash() bool {
 	return l.ch == '\\'
 }
 
-// Allowed charachter set for defining identifiers
-// TODO: Add digits as allowed
+func (l *lexer) isDigit() bool {
+	return '0' <= l.ch && l.ch <= '9'
+}
+
+// Allowed charachter set for defining identifiers.
+// Digits are allowed too, after the first character
 func (l *lexer) isAlpha() bool {
 	return 'a' <= l.ch && l.ch <= 'z' ||
 		'A' <= l.ch && l.ch <= 'Z' ||
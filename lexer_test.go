@@ -36,6 +36,16 @@ func TestLexer(t *testing.T) {
 				{Type: EOF, Value: "EOF"},
 			},
 		},
+		{
+			Input: "b64dec(_)",
+			Tokens: []token{
+				{Type: IDENT, Value: "b64dec"},
+				{Type: L_PARENS, Value: "("},
+				{Type: STRING, Value: "_"},
+				{Type: R_PARENS, Value: ")"},
+				{Type: EOF, Value: "EOF"},
+			},
+		},
 		{
 			// Missing R_PARENS
 			Input: `
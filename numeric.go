@@ -0,0 +1,378 @@
+package patman
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type unitKind int
+
+const (
+	unitNone unitKind = iota
+	unitDuration
+	unitBytes
+)
+
+// durationUnits are in nanoseconds
+var durationUnits = map[string]float64{
+	"ns": 1,
+	"us": 1e3,
+	"µs": 1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60e9,
+	"h":  3600e9,
+	"d":  86400e9,
+}
+
+// byteUnits are in bytes, matched case insensitively. SI
+// prefixes are powers of 1000, IEC prefixes powers of 1024
+var byteUnits = map[string]float64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"pb":  1e15,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+}
+
+// parseQuantity parses a number, optionally followed by a duration or
+// byte size unit. Durations are returned in nanoseconds, sizes in bytes.
+// e.g. `42`, `250ms`, `1.5s`, `1h30m`, `1.2GiB`, `512 KB`
+func parseQuantity(value string) (float64, unitKind, error) {
+	value = strings.TrimSpace(value)
+	if num, err := strconv.ParseFloat(value, 64); err == nil {
+		return num, unitNone, nil
+	}
+
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.' && r != '-' && r != '+'
+	})
+	if i <= 0 {
+		return 0, unitNone, fmt.Errorf("`%s` is not a valid quantity", value)
+	}
+	num, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, unitNone, fmt.Errorf("`%s` is not a valid quantity", value)
+	}
+
+	unit := strings.TrimSpace(value[i:])
+	if size, ok := byteUnits[strings.ToLower(unit)]; ok {
+		return num * size, unitBytes, nil
+	}
+	if size, ok := durationUnits[unit]; ok {
+		return num * size, unitDuration, nil
+	}
+	// compound durations, e.g. 1h30m
+	if d, err := parseDuration(strings.ReplaceAll(value, " ", "")); err == nil {
+		return float64(d), unitDuration, nil
+	}
+
+	return 0, unitNone, fmt.Errorf("`%s` is not a valid quantity", value)
+}
+
+// compareQuantity filters lines whose quantity satisfies keep when
+// compared with the quantity in arg. Lines that are not quantities
+// of the same kind as arg, e.g. bytes against a duration, are filtered out
+func compareQuantity(line, arg, op string, keep func(val, limit float64) bool) (string, error) {
+	limit, limitKind, err := parseQuantity(arg)
+	if err != nil {
+		return "", fmt.Errorf("`%s` is not a valid number for %s operator", arg, op)
+	}
+
+	val, kind, err := parseQuantity(line)
+	if err != nil || kind != limitKind {
+		return "", nil
+	}
+
+	if keep(val, limit) {
+		return line, nil
+	}
+	return "", nil
+}
+
+var matchNumber = regexp.MustCompile(`[-+]?(\d+(\.\d*)?|\.\d+)([eE][-+]?\d+)?`)
+
+// handleNum extracts the first number of a line, filtering out lines without numbers
+func handleNum(line, arg string) (string, error) {
+	return matchNumber.FindString(line), nil
+}
+
+// handleRound rounds numbers to the provided number of decimals
+func handleRound(line, arg string) (string, error) {
+	num, ok := parseNumber(line)
+	if !ok {
+		return "", nil
+	}
+
+	decimals, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || decimals < 0 {
+		return "", fmt.Errorf("`%s` is not a valid number of decimals for round operator", arg)
+	}
+
+	return strconv.FormatFloat(num, 'f', decimals, 64), nil
+}
+
+// handlePrintf formats numbers using a printf verb. Integer
+// verbs like %d or %x format the number truncated to an integer
+func handlePrintf(line, arg string) (string, error) {
+	num, ok := parseNumber(line)
+	if !ok {
+		return "", nil
+	}
+
+	verb, ok := printfVerb(arg)
+	if !ok {
+		return "", fmt.Errorf("`%s` is not a valid format for printf operator, expected a single verb", arg)
+	}
+
+	switch verb {
+	case 'd', 'x', 'X', 'o', 'b', 'c':
+		return fmt.Sprintf(arg, int64(num)), nil
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		return fmt.Sprintf(arg, num), nil
+	}
+	return "", fmt.Errorf("`%s` is not a valid format for printf operator", arg)
+}
+
+// printfVerb returns the verb of a format with exactly one verb,
+// skipping flags, width and precision. `%%` is a literal percent sign.
+// e.g. `%08.2f ms` -> f
+func printfVerb(format string) (verb byte, ok bool) {
+	verbs := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i == len(format) {
+			return 0, false
+		}
+		if format[i] == '%' {
+			continue
+		}
+		verb = format[i]
+		verbs++
+	}
+	return verb, verbs == 1
+}
+
+// newCalc parses the expression when the plan is compiled, so that
+// invalid expressions are reported upfront rather than on every line.
+// The result is an operator evaluating it against x, the numeric value
+// of the line. Non-numeric lines are filtered out.
+// e.g. `x * 1000`, `(x - 32) / 1.8`, `round(x / 1024)`
+func newCalc(arg string) operator {
+	expr, err := parseExpression(arg)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	return func(line, arg string) (string, error) {
+		x, ok := parseNumber(line)
+		if !ok {
+			return "", nil
+		}
+
+		result := expr(x)
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return "", nil
+		}
+		return formatNumber(result), nil
+	}
+}
+
+// expression is a compiled arithmetic expression of x
+type expression func(x float64) float64
+
+var expressionFunctions = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"ceil":  math.Ceil,
+	"floor": math.Floor,
+	"round": math.Round,
+	"sqrt":  math.Sqrt,
+	"log":   math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"exp":   math.Exp,
+}
+
+// parseExpression compiles an arithmetic expression supporting
+// + - * / % ^, parentheses, numbers, x and the functions
+// in expressionFunctions, with the usual precedence
+func parseExpression(src string) (expression, error) {
+	p := &expressionParser{src: src}
+	expr, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected `%s` in calc expression `%s`", p.src[p.pos:], src)
+	}
+	return expr, nil
+}
+
+type expressionParser struct {
+	src string
+	pos int
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *expressionParser) peek() byte {
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *expressionParser) sum() (expression, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == '+' {
+			left = func(x float64) float64 { return l(x) + right(x) }
+		} else {
+			left = func(x float64) float64 { return l(x) - right(x) }
+		}
+	}
+}
+
+func (p *expressionParser) product() (expression, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		switch op {
+		case '*':
+			left = func(x float64) float64 { return l(x) * right(x) }
+		case '/':
+			left = func(x float64) float64 { return l(x) / right(x) }
+		default:
+			left = func(x float64) float64 { return math.Mod(l(x), right(x)) }
+		}
+	}
+}
+
+// unary minus binds looser than ^, so that -2^2 is -4
+func (p *expressionParser) unary() (expression, error) {
+	if p.peek() == '-' {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(x float64) float64 { return -operand(x) }, nil
+	}
+	return p.power()
+}
+
+// power is right associative, so that 2^3^2 is 2^9.
+// Exponents can be negative, e.g. 2^-1
+func (p *expressionParser) power() (expression, error) {
+	base, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != '^' {
+		return base, nil
+	}
+	p.pos++
+	exponent, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(x float64) float64 { return math.Pow(base(x), exponent(x)) }, nil
+}
+
+func (p *expressionParser) operand() (expression, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		expr, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing `)` in calc expression `%s`", p.src)
+		}
+		p.pos++
+		return expr, nil
+
+	case c >= '0' && c <= '9' || c == '.':
+		num := matchNumber.FindString(p.src[p.pos:])
+		value, err := strconv.ParseFloat(num, 64)
+		if err != nil || num == "" {
+			return nil, fmt.Errorf("invalid number in calc expression `%s`", p.src)
+		}
+		p.pos += len(num)
+		return func(x float64) float64 { return value }, nil
+
+	case c >= 'a' && c <= 'z':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= 'a' && p.src[p.pos] <= 'z' || p.src[p.pos] >= '0' && p.src[p.pos] <= '9') {
+			p.pos++
+		}
+		ident := p.src[start:p.pos]
+		if ident == "x" {
+			return func(x float64) float64 { return x }, nil
+		}
+
+		fn, ok := expressionFunctions[ident]
+		if !ok {
+			return nil, fmt.Errorf("unknown `%s` in calc expression `%s`", ident, p.src)
+		}
+		if p.peek() != '(' {
+			return nil, fmt.Errorf("missing `(` after `%s` in calc expression `%s`", ident, p.src)
+		}
+		arg, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return func(x float64) float64 { return fn(arg(x)) }, nil
+	}
+
+	return nil, fmt.Errorf("unexpected end of calc expression `%s`", p.src)
+}
@@ -0,0 +1,87 @@
+package patman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumeric(t *testing.T) {
+	t.Run("Should parse quantities with units", func(t *testing.T) {
+		cases := map[string]struct {
+			value float64
+			kind  unitKind
+		}{
+			"42":     {42, unitNone},
+			"250ms":  {250e6, unitDuration},
+			"1.5s":   {1.5e9, unitDuration},
+			"1h30m":  {5400e9, unitDuration},
+			"1.5GiB": {1.5 * (1 << 30), unitBytes},
+			"512 KB": {512e3, unitBytes},
+		}
+		for input, expected := range cases {
+			value, kind, err := parseQuantity(input)
+			assert.NoError(t, err, input)
+			assert.Equal(t, expected.kind, kind, input)
+			assert.InDelta(t, expected.value, value, 1e-6, input)
+		}
+
+		_, _, err := parseQuantity("12 parsecs")
+		assert.Error(t, err)
+	})
+
+	t.Run("Should compare quantities of the same kind", func(t *testing.T) {
+		out, _ := handleGt("1.5s", "500ms")
+		assert.Equal(t, "1.5s", out)
+		out, _ = handleGt("200ms", "500ms")
+		assert.Empty(t, out)
+		out, _ = handleGt("2GB", "500ms")
+		assert.Empty(t, out)
+		out, _ = handleLte("100", "100")
+		assert.Equal(t, "100", out)
+	})
+
+	t.Run("Should evaluate expressions", func(t *testing.T) {
+		cases := map[string]string{
+			"x * 1000":            "2500",
+			"(x - 0.5) / 2":       "1",
+			"2 ^ 3 ^ 2 + x * 0":   "512",
+			"-x + 10 % 4":         "-0.5",
+			"round(x) + floor(x)": "5",
+			"-2^2":                "-4",
+			"-x^2 + 2^-1":         "-5.75",
+			"x * -2":              "-5",
+		}
+		for expr, expected := range cases {
+			out, err := newCalc(expr)("2.5", expr)
+			assert.NoError(t, err, expr)
+			assert.Equal(t, expected, out, expr)
+		}
+
+		_, err := parseExpression("x +")
+		assert.Error(t, err)
+
+		out, _ := newCalc("x * 2")("n/a", "x * 2")
+		assert.Equal(t, "", out)
+	})
+
+	t.Run("Should format numbers with a single printf verb", func(t *testing.T) {
+		cases := map[string]string{
+			"%d":      "42",
+			"%08.2f":  "00042.50",
+			"%x":      "2a",
+			"%.1f%%":  "42.5%",
+			"%.0f ms": "42 ms",
+		}
+		for format, expected := range cases {
+			out, err := handlePrintf("42.5", format)
+			assert.NoError(t, err, format)
+			assert.Equal(t, expected, out, format)
+		}
+
+		for _, format := range []string{"%d%d", "%s", "no verb", "%", "%d ms %"} {
+			_, err := handlePrintf("42.5", format)
+			assert.Error(t, err, format)
+		}
+	})
+}
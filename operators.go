@@ -2,7 +2,6 @@ package patman
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 	"strconv"
@@ -13,21 +12,59 @@ import (
 	"github.com/dop251/goja"
 )
 
-var regexCache = sync.Map{} // map[string]*regexp.Regexp
+var regexCache = sync.Map{} // map[string]*prefiltered
 
-func regex(pattern string) *regexp.Regexp {
+func regex(pattern string) *prefiltered {
 	if cached, ok := regexCache.Load(pattern); ok {
-		return cached.(*regexp.Regexp)
+		return cached.(*prefiltered)
 	}
 
 	re, err := regexp.Compile(pattern)
 	if err != nil {
-		log.Fatalf("`%s` is not a valid regexp pattern", pattern)
+		fatalf("`%s` is not a valid regexp pattern", pattern)
 	}
 
-	regexCache.Store(pattern, re)
+	p := newPrefiltered(re)
+	regexCache.Store(pattern, p)
 
-	return re
+	return p
+}
+
+var automatonCache = sync.Map{} // map[string]*ahoCorasick
+
+// automaton compiles the patterns of filterany-like operators once per argument.
+// Patterns are either comma separated or read line by line from a file
+// when the argument starts with `@`. e.g. `a,b,c` or `@ids.txt`.
+// Empty patterns are skipped, as they would match every line
+func automaton(arg string) *ahoCorasick {
+	if cached, ok := automatonCache.Load(arg); ok {
+		return cached.(*ahoCorasick)
+	}
+
+	var patterns []string
+	if path, ok := strings.CutPrefix(arg, "@"); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fatalf("failed to read patterns file: %v", err)
+		}
+		for _, pattern := range strings.Split(string(content), "\n") {
+			pattern = strings.TrimRight(pattern, "\r")
+			if pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	} else {
+		for _, pattern := range strings.Split(arg, ",") {
+			if pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+
+	ac := newAhoCorasick(patterns)
+	automatonCache.Store(arg, ac)
+
+	return ac
 }
 
 type OperatorEntry struct {
@@ -35,6 +72,15 @@ type OperatorEntry struct {
 	Usage    string
 	Alias    string
 	Example  string
+
+	// Stateful operators depend on previously seen lines. Their stages
+	// are never shared across pipelines by the compiled plan
+	Stateful bool
+
+	// New, when set, is called with the operator argument to create
+	// the operator of each stage when the plan is compiled, so that
+	// stages keep their own state or prepare their argument once
+	New func(arg string) operator
 }
 
 type operator func(line string, arg string) (string, error)
@@ -123,11 +169,29 @@ var operators = map[string]OperatorEntry{
 		Operator: handleFilter,
 		Usage:    "matches entire line that contains substring. Useful for quickly filtering large files (> 1GB). Way quicker than cat+grep",
 		Example:  "cat logs.txt | filter(hello) # -> ... matching lines",
-		Alias:    "mf",
+		Alias:    "f",
 	},
 	"f": {
 		Operator: handleFilter,
 	},
+	"filterany": {
+		New:     newFilterAny,
+		Usage:   "matches entire line that contains any of the comma separated substrings, or of the lines of a file when prefixed by `@`. Scales with line length rather than number of substrings",
+		Example: "cat logs.txt | filterany(@ids.txt) # -> ... matching lines",
+		Alias:   "fa",
+	},
+	"fa": {
+		New: newFilterAny,
+	},
+	"notfilterany": {
+		New:     newNotFilterAny,
+		Usage:   "returns entire lines that contain none of the comma separated substrings, or of the lines of a file when prefixed by `@`",
+		Example: "cat logs.txt | notfilterany(DEBUG,TRACE) # -> ... non-matching lines",
+		Alias:   "nfa",
+	},
+	"nfa": {
+		New: newNotFilterAny,
+	},
 	"cut": {
 		Operator: handleCut,
 		Usage:    "split line by delimiter and select field(s) by index or range",
@@ -155,40 +219,292 @@ var operators = map[string]OperatorEntry{
 	"lower": {
 		Operator: handleLowercase,
 	},
+	"trim": {
+		Operator: handleTrim,
+		Usage:    "removes leading and trailing whitespace, or the provided characters",
+		Example:  "echo '  hello  ' | trim(_) # -> hello",
+	},
+	"trimprefix": {
+		Operator: handleTrimPrefix,
+		Usage:    "removes the provided prefix",
+		Example:  "echo 'user=alice' | trimprefix(user=) # -> alice",
+	},
+	"trimsuffix": {
+		Operator: handleTrimSuffix,
+		Usage:    "removes the provided suffix",
+		Example:  "echo '250ms' | trimsuffix(ms) # -> 250",
+	},
+	"substr": {
+		Operator: handleSubstr,
+		Usage:    "returns the characters from start, up to an optional length. A negative start counts from the end",
+		Example:  "echo 'hello world' | substr(6/3) # -> wor",
+	},
+	"pad": {
+		Operator: handlePad,
+		Usage:    "pads to a width with a character (default space), on the left or right (default)",
+		Example:  "echo 42 | pad(6/0/left) # -> 000042",
+	},
+	"len": {
+		Operator: handleLen,
+		Usage:    "returns the number of characters",
+		Example:  "echo 'héllo' | len(_) # -> 5",
+	},
+	"reverse": {
+		Operator: handleReverse,
+		Usage:    "reverses the characters",
+		Example:  "echo 'hello' | reverse(_) # -> olleh",
+	},
+	"repeat": {
+		Operator: handleRepeat,
+		Usage:    "repeats a line the provided number of times",
+		Example:  "echo 'ab' | repeat(3) # -> ababab",
+	},
+	"title": {
+		Operator: handleTitle,
+		Usage:    "converts to title case",
+		Example:  "echo 'hello world' | title(_) # -> Hello World",
+	},
+	"casefold": {
+		Operator: handleCaseFold,
+		Usage:    "folds case for caseless comparisons, e.g. with uniq",
+		Example:  "echo 'Straße' | casefold(_) # -> strasse",
+	},
+	"normalize": {
+		Operator: handleNormalize,
+		Usage:    "applies a unicode normalization form: nfc, nfd, nfkc or nfkd",
+		Example:  "echo 'ｈｅｌｌｏ' | normalize(nfkc) # -> hello",
+	},
+	"b64enc": {
+		Operator: handleBase64Encode,
+		Usage:    "encodes to base64 using the std (default) or url alphabet",
+		Example:  "echo 'hello' | b64enc(_) # -> aGVsbG8=",
+	},
+	"b64dec": {
+		Operator: handleBase64Decode,
+		Usage:    "decodes base64 using the std (default) or url alphabet, with or without padding",
+		Example:  "echo 'aGVsbG8=' | b64dec(_) # -> hello",
+	},
+	"hexenc": {
+		Operator: handleHexEncode,
+		Usage:    "encodes to hex",
+		Example:  "echo 'hi' | hexenc(_) # -> 6869",
+	},
+	"hexdec": {
+		Operator: handleHexDecode,
+		Usage:    "decodes hex",
+		Example:  "echo '6869' | hexdec(_) # -> hi",
+	},
+	"urlenc": {
+		Operator: handleURLEncode,
+		Usage:    "escapes a query parameter (default) or a path segment",
+		Example:  "echo 'a b&c' | urlenc(_) # -> a+b%26c",
+	},
+	"urldec": {
+		Operator: handleURLDecode,
+		Usage:    "unescapes a query parameter (default) or a path segment",
+		Example:  "echo 'a+b%26c' | urldec(_) # -> a b&c",
+	},
+	"jsonunescape": {
+		Operator: handleJSONUnescape,
+		Usage:    "unescapes a JSON string, quoted or not",
+		Example:  `echo '{\"a\":1}' | jsonunescape(_) # -> {"a":1}`,
+	},
+	"htmlunescape": {
+		Operator: handleHTMLUnescape,
+		Usage:    "unescapes HTML entities",
+		Example:  "echo '&lt;b&gt;' | htmlunescape(_) # -> <b>",
+	},
+	"jwt": {
+		Operator: handleJWT,
+		Usage:    "decodes the header, claims or both (_) of a JWT, without verifying its signature",
+		Example:  "cat access.log | patman 'm(Bearer \\S+) |> jwt(claims)'",
+	},
+	"redact": {
+		Operator: handleRedact,
+		Usage:    "masks emails, ips, cards or phones, comma separated, or the matches of a regex",
+		Example:  "echo 'ann@x.com from 10.0.0.1' | redact(email,ip) # -> [EMAIL] from [IP]",
+	},
+	"pseudonymize": {
+		Operator: handlePseudonymize,
+		Usage:    "replaces the matches of a regex, or of a kind known by redact, with a stable token derived from their HMAC with the key in keyfile",
+		Example:  "cat app.log | patman 'pseudonymize(email/secret.key)'",
+	},
+	"sha256": {
+		Operator: handleSha256,
+		Usage:    "hex encoded SHA-256 of the line",
+		Example:  "echo 'hello' | sha256(_) # -> 2cf24dba...",
+	},
+	"hmac": {
+		Operator: handleHmac,
+		Usage:    "hex encoded HMAC-SHA256 of the line with the key in the file passed as argument",
+		Example:  "echo 'hello' | hmac(secret.key)",
+	},
 	"uniq": {
-		Operator: handleUniq,
-		Usage:    "remove duplicate lines (keeps first occurrence)",
-		Example:  "cat logs.txt | patman 'ml(error) |> uniq(_)'",
+		New:      newUniq,
+		Usage:    "remove duplicate lines (keeps first occurrence) within a pipeline. lru/N remembers only the N most recent lines, bloom/N uses a Bloom filter sized for N lines dropping ~1% of distinct lines",
+		Example:  "cat logs.txt | patman 'ml(error) |> uniq(_)' 'ml(warn) |> uniq(bloom/1000000)'",
 		Alias:    "u",
+		Stateful: true,
 	},
 	"u": {
-		Operator: handleUniq,
+		New:      newUniq,
+		Stateful: true,
+	},
+	"uniqby": {
+		New:      newUniqBy,
+		Usage:    "remove lines whose first match of the expression was already seen, passing through the original line. Lines without a match are kept",
+		Example:  "cat logs.txt | patman 'uniqby(user=\\w+)'",
+		Alias:    "ub",
+		Stateful: true,
+	},
+	"ub": {
+		New:      newUniqBy,
+		Stateful: true,
+	},
+	"sample": {
+		New:      newSample,
+		Usage:    "keeps each line with the provided probability. An optional seed makes the sample reproducible with -workers 1",
+		Example:  "cat huge.log | patman 'sample(0.01)' 'sample(0.01/42)'",
+		Stateful: true,
+	},
+	"every": {
+		New:      newEvery,
+		Usage:    "keeps one line every N, starting from the first one",
+		Example:  "cat huge.log | patman 'every(1000)'",
+		Stateful: true,
+	},
+	"reservoir": {
+		New:      newReservoir,
+		Usage:    "prints a uniform sample of K lines once input ends, in input order. Must be the last operator of a pipeline. An optional seed makes the sample reproducible with -workers 1",
+		Example:  "cat huge.log | patman 'ml(error) |> reservoir(100)'",
+		Stateful: true,
+	},
+	"head": {
+		New:      newHead,
+		Usage:    "keeps the first N lines. When all pipelines have a head, input stops being read once all of them are satisfied",
+		Example:  "cat huge.log | patman 'ml(error) |> head(10)'",
+		Stateful: true,
+	},
+	"tail": {
+		New:      newTail,
+		Usage:    "prints the last N lines once input ends. Must be the last operator of a pipeline",
+		Example:  "cat huge.log | patman 'ml(error) |> tail(10)'",
+		Stateful: true,
 	},
 	"gt": {
 		Operator: handleGt,
-		Usage:    "filters lines that are numerically greater than the provided number",
+		Usage:    "filters lines that are numerically greater than the provided number, duration (e.g. 500ms) or byte size (e.g. 1.5GiB)",
 		Example:  "echo 101 | gt(100) # -> 101",
 	},
 	"gte": {
 		Operator: handleGte,
-		Usage:    "filters lines that are numerically greater than or equal to the provided number",
+		Usage:    "filters lines that are numerically greater than or equal to the provided number, duration or byte size",
 		Example:  "echo 100 | gte(100) # -> 100",
 	},
 	"lt": {
 		Operator: handleLt,
-		Usage:    "filters lines that are numerically less than the provided number",
+		Usage:    "filters lines that are numerically less than the provided number, duration or byte size",
 		Example:  "echo 99 | lt(100) # -> 99",
 	},
 	"lte": {
 		Operator: handleLte,
-		Usage:    "filters lines that are numerically less than or equal to the provided number",
+		Usage:    "filters lines that are numerically less than or equal to the provided number, duration or byte size",
 		Example:  "echo 100 | lte(100) # -> 100",
 	},
 	"eq": {
 		Operator: handleEq,
-		Usage:    "filters lines that are numerically equal to the provided number",
+		Usage:    "filters lines that are numerically equal to the provided number, duration or byte size",
 		Example:  "echo 100 | eq(100) # -> 100",
 	},
+	"num": {
+		Operator: handleNum,
+		Usage:    "extracts the first number of a line",
+		Example:  "echo 'took 250ms' | num(_) # -> 250",
+	},
+	"calc": {
+		New:     newCalc,
+		Usage:   "evaluates an arithmetic expression of x, the numeric value of the line. Supports + - * / % ^, parentheses and abs, ceil, floor, round, sqrt, log, log2, log10, exp",
+		Example: "echo 1.5 | calc(x * 1000) # -> 1500",
+	},
+	"round": {
+		Operator: handleRound,
+		Usage:    "rounds a number to the provided number of decimals",
+		Example:  "echo 3.14159 | round(2) # -> 3.14",
+	},
+	"printf": {
+		Operator: handlePrintf,
+		Usage:    "formats a number using a printf verb",
+		Example:  "echo 42 | printf(%08.2f) # -> 00042.00",
+	},
+	"time": {
+		Operator: handleTime,
+		Usage:    "parses a timestamp and formats it in another layout and timezone. Arguments are `|` separated: input layout (or auto), output layout (default rfc3339) and timezone. Layouts are Go layouts or one of rfc3339, rfc3339nano, rfc1123, datetime, date, syslog, apache, kitchen, unix, unixms, unixus, unixns. Lines that are not timestamps are filtered out",
+		Example:  "echo 1704207845123 | time(auto|datetime|Europe/Rome) # -> 2024-01-02 16:04:05",
+		Alias:    "t",
+	},
+	"t": {
+		Operator: handleTime,
+	},
+	"since": {
+		Operator: handleSince,
+		Usage:    "filters timestamps at or after the provided time. Accepts absolute times, `now` or relative times like `15m ago` or `2d ago`",
+		Example:  "cat logs.txt | split( /0) |> since(1h ago)",
+	},
+	"until": {
+		Operator: handleUntil,
+		Usage:    "filters timestamps at or before the provided time. Accepts absolute times, `now` or relative times like `15m ago` or `2d ago`",
+		Example:  "cat logs.txt | split( /0) |> until(2024-01-02T15:00:00Z)",
+	},
+	"count": {
+		Operator: handleAggregate,
+		Usage:    "counts the lines matched by a named pipeline. Printed once input ends, for each -groupby value",
+		Example:  "cat logs.txt | patman -groupby level 'split( /2) |> name(level)' 'ml(.) |> count(_) |> name(lines)'",
+	},
+	"sum": {
+		Operator: handleAggregate,
+		Usage:    "sums the numeric matches of a named pipeline. Printed once input ends, for each -groupby value",
+		Example:  "cat logs.txt | patman 'm(amount=\\d+) |> m(\\d+) |> sum(_) |> name(total)'",
+	},
+	"avg": {
+		Operator: handleAggregate,
+		Usage:    "averages the numeric matches of a named pipeline. Printed once input ends, for each -groupby value",
+		Example:  "cat logs.txt | patman 'm(took \\d+) |> m(\\d+) |> avg(_) |> name(latency)'",
+	},
+	"min": {
+		Operator: handleAggregate,
+		Usage:    "minimum of the numeric matches of a named pipeline. Printed once input ends, for each -groupby value",
+		Example:  "cat logs.txt | patman 'm(took \\d+) |> m(\\d+) |> min(_) |> name(fastest)'",
+	},
+	"percentiles": {
+		Operator: handleAggregate,
+		Usage:    "estimates comma separated percentiles of the numeric matches of a named pipeline, using bounded memory. Printed once input ends, for each -groupby value",
+		Example:  "cat logs.txt | patman 'm(took \\d+) |> m(\\d+) |> percentiles(50,95,99) |> name(latency)'",
+	},
+	"histogram": {
+		Operator: handleAggregate,
+		Usage:    "counts the numeric matches of a named pipeline in buckets delimited by comma separated upper bounds. Printed once input ends, for each -groupby value",
+		Example:  "cat logs.txt | patman 'm(took \\d+) |> m(\\d+) |> histogram(10,100,1000) |> name(latency)'",
+	},
+	"distinct": {
+		Operator: handleAggregate,
+		Usage:    "estimated number of distinct matches of a named pipeline, using a HyperLogLog sketch (~0.8% error). Printed once input ends, for each -groupby value",
+		Example:  "cat access.log | patman 'split( /0) |> distinct(_) |> name(visitors)'",
+	},
+	"sort": {
+		Operator: handleSort,
+		Usage:    "sorts output records by a named pipeline once input ends, spilling to temporary files beyond -mem. Options are / separated: asc (default), desc, numeric. Must be a pipeline of its own",
+		Example:  "cat access.log | patman 'split( /2) |> name(latency)' 'sort(latency/desc/numeric)'",
+	},
+	"topk": {
+		Operator: handleAggregate,
+		Usage:    "most frequent matches of a named pipeline with their counts, estimated with a bounded number of counters (default max(100, 10*N)). Printed once input ends, for each -groupby value",
+		Example:  "cat access.log | patman 'split( /0) |> topk(10) |> name(ips)'",
+	},
+	"max": {
+		Operator: handleAggregate,
+		Usage:    "maximum of the numeric matches of a named pipeline. Printed once input ends, for each -groupby value",
+		Example:  "cat logs.txt | patman 'm(took \\d+) |> m(\\d+) |> max(_) |> name(slowest)'",
+	},
 }
 
 func Register(name string, o OperatorEntry) {
@@ -201,6 +517,71 @@ func handleName(line, arg string) (string, error) {
 	return line, nil
 }
 
+func handleTime(line, arg string) (string, error) {
+	spec := strings.Split(arg, "|")
+	input, output := spec[0], "rfc3339"
+	if len(spec) > 1 {
+		output = spec[1]
+	}
+
+	t, err := parseTimeLayout(line, input)
+	if err != nil {
+		return "", nil // Filter out lines that are not timestamps
+	}
+
+	if len(spec) > 2 {
+		loc, err := location(spec[2])
+		if err != nil {
+			return "", err
+		}
+		t = t.In(loc)
+	}
+
+	return formatTimeLayout(t, output), nil
+}
+
+func handleSince(line, arg string) (string, error) {
+	bound, err := parseBound(arg)
+	if err != nil {
+		return "", fmt.Errorf("`%s` is not a valid time for since operator", arg)
+	}
+	t, err := parseTime(line)
+	if err != nil {
+		return "", nil // Filter out lines that are not timestamps
+	}
+	if !t.Before(bound) {
+		return line, nil
+	}
+	return "", nil
+}
+
+func handleUntil(line, arg string) (string, error) {
+	bound, err := parseBound(arg)
+	if err != nil {
+		return "", fmt.Errorf("`%s` is not a valid time for until operator", arg)
+	}
+	t, err := parseTime(line)
+	if err != nil {
+		return "", nil // Filter out lines that are not timestamps
+	}
+	if !t.After(bound) {
+		return line, nil
+	}
+	return "", nil
+}
+
+// handleAggregate passes lines through to the pipeline aggregator,
+// accumulating them until input ends
+func handleAggregate(line, arg string) (string, error) {
+	return line, nil
+}
+
+// handleSort is never run, as sort pipelines only
+// define the order of output records
+func handleSort(line, arg string) (string, error) {
+	return line, nil
+}
+
 func handleMatch(line, arg string) (string, error) {
 	return regex(arg).FindString(line), nil
 }
@@ -261,6 +642,28 @@ func handleFilter(line, arg string) (string, error) {
 	return "", nil
 }
 
+// newFilterAny builds the automaton when the plan is compiled, so that
+// pattern files are read once and missing ones are reported upfront
+func newFilterAny(arg string) operator {
+	ac := automaton(arg)
+	return func(line, arg string) (string, error) {
+		if ac.contains(line) {
+			return line, nil
+		}
+		return "", nil
+	}
+}
+
+func newNotFilterAny(arg string) operator {
+	ac := automaton(arg)
+	return func(line, arg string) (string, error) {
+		if !ac.contains(line) {
+			return line, nil
+		}
+		return "", nil
+	}
+}
+
 func handleNotMatchLine(line, arg string) (string, error) {
 	if !regex(arg).MatchString(line) {
 		return line, nil
@@ -325,88 +728,24 @@ func handleLowercase(line, arg string) (string, error) {
 	return strings.ToLower(line), nil
 }
 
-var uniq sync.Map
-
-func handleUniq(line, arg string) (string, error) {
-	if _, loaded := uniq.LoadOrStore(line, true); loaded {
-		return "", nil
-	}
-	return line, nil
-}
-
 func handleGt(line, arg string) (string, error) {
-	val, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
-	if err != nil {
-		return "", nil // Filter out non-numeric lines
-	}
-	limit, err := strconv.ParseFloat(arg, 64)
-	if err != nil {
-		return "", fmt.Errorf("`%s` is not a valid number for gt operator", arg)
-	}
-	if val > limit {
-		return line, nil
-	}
-	return "", nil
+	return compareQuantity(line, arg, "gt", func(val, limit float64) bool { return val > limit })
 }
 
 func handleGte(line, arg string) (string, error) {
-	val, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
-	if err != nil {
-		return "", nil // Filter out non-numeric lines
-	}
-	limit, err := strconv.ParseFloat(arg, 64)
-	if err != nil {
-		return "", fmt.Errorf("`%s` is not a valid number for gte operator", arg)
-	}
-	if val >= limit {
-		return line, nil
-	}
-	return "", nil
+	return compareQuantity(line, arg, "gte", func(val, limit float64) bool { return val >= limit })
 }
 
 func handleLt(line, arg string) (string, error) {
-	val, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
-	if err != nil {
-		return "", nil // Filter out non-numeric lines
-	}
-	limit, err := strconv.ParseFloat(arg, 64)
-	if err != nil {
-		return "", fmt.Errorf("`%s` is not a valid number for lt operator", arg)
-	}
-	if val < limit {
-		return line, nil
-	}
-	return "", nil
+	return compareQuantity(line, arg, "lt", func(val, limit float64) bool { return val < limit })
 }
 
 func handleLte(line, arg string) (string, error) {
-	val, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
-	if err != nil {
-		return "", nil // Filter out non-numeric lines
-	}
-	limit, err := strconv.ParseFloat(arg, 64)
-	if err != nil {
-		return "", fmt.Errorf("`%s` is not a valid number for lte operator", arg)
-	}
-	if val <= limit {
-		return line, nil
-	}
-	return "", nil
+	return compareQuantity(line, arg, "lte", func(val, limit float64) bool { return val <= limit })
 }
 
 func handleEq(line, arg string) (string, error) {
-	val, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
-	if err != nil {
-		return "", nil // Filter out non-numeric lines
-	}
-	limit, err := strconv.ParseFloat(arg, 64)
-	if err != nil {
-		return "", fmt.Errorf("`%s` is not a valid number for eq operator", arg)
-	}
-	if val == limit {
-		return line, nil
-	}
-	return "", nil
+	return compareQuantity(line, arg, "eq", func(val, limit float64) bool { return val == limit })
 }
 
 // TODO: should support empty char splitting
@@ -461,7 +800,7 @@ func Args(arg string) []string {
 	parts := strings.Split(arg, "/")
 	if len(parts) < 2 {
 		fmt.Printf("missing argument: %v\n", parts)
-		os.Exit(1)
+		exit(exitError)
 	}
 
 	return []string{
@@ -50,6 +50,16 @@ func TestParser(t *testing.T) {
 		assert.Equal(t, "  /__", pipelines[0].Arg)
 	})
 
+	t.Run("Should handle arguments starting with parentheses", func(t *testing.T) {
+		parser := NewParser(`calc((x - 32) / 1.8) |> match((a|b)c)`)
+		pipelines, err := parser.Parse()
+		assert.NoError(t, err)
+		assert.Len(t, pipelines, 2)
+
+		assert.Equal(t, "(x - 32) / 1.8", pipelines[0].Arg)
+		assert.Equal(t, "(a|b)c", pipelines[1].Arg)
+	})
+
 	t.Run("Should parse empty string", func(t *testing.T) {
 		parser := NewParser("")
 		pipelines, err := parser.Parse()
@@ -5,56 +5,113 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // Job represents the parallelizable unit of work happening at line level.
 // Each line is distributed to a worker and then handed back to a collector
 type Job struct {
-	Seq  int64
-	Line string
+	Seq    int64
+	Line   string
+	Offset int64
 }
 
 type Result struct {
-	Seq int64
+	Seq    int64
+	Line   string
+	Offset int64
 
 	// [{match, name}, ...]
 	Results [][]string
-	Err     error
+	Errs    []pipelineError
+
+	// Aggregated results are held by the worker aggregation
+	// and are not printed by the collector
+	Aggregated bool
 }
 
 var input string
 var index string
+var indexTimeout string
+var indexMaxKeys int
+var indexMarker string
+var indexMulti bool
+var groupBy string
+var windowSize time.Duration
+var timeField string
+var lateness time.Duration
+var since string
+var until string
+var sorted bool
 var format string
 var mem int
 var help bool
 var exitOnError bool
+var onError string
+var errorsPath string
 var workers int
 var queueSize int
+var unordered bool
+var uniqCount bool
+var countMatches bool
+var quiet bool
+var maxCount int64
+var contextAround int
+var reorderWindow int
 var pipelines [][]Command
+var compiled *plan
 var pipelineNames []string
 var delimiter string
 var joinDelimiter string
 var stdoutBufferSize int
+var longLines string
 
 func init() {
 	flag.StringVar(&input, "file", "", "input file")
-	flag.StringVar(&index, "index", "", "index property used to aggregate logs")
+	flag.StringVar(&index, "index", "", "index property used to aggregate logs. Comma separated names define a composite index")
+	flag.BoolVar(&indexMulti, "index-multi", false, "collect repeated pipelines of an index group instead of keeping the last one. Groups are printed on timeout, eviction or end of input")
+	flag.StringVar(&indexTimeout, "index-timeout", "", "print incomplete index groups not updated for a number of lines (e.g. 10000) or a duration (e.g. 30s)")
+	flag.IntVar(&indexMaxKeys, "index-max-keys", 0, "max number of incomplete index groups kept in memory, least recently updated ones are printed first (0 = unlimited)")
+	flag.StringVar(&indexMarker, "index-marker", "", "value printed in place of missing pipelines for incomplete index groups")
+	flag.StringVar(&groupBy, "groupby", "", "named pipeline used to group aggregate operators (count, sum, avg, min, max)")
+	flag.DurationVar(&windowSize, "window", 0, "aggregate records in time windows of the provided duration (e.g. 1m), printing each window once complete")
+	flag.StringVar(&timeField, "time-field", "", "named pipeline extracting the record timestamp")
+	flag.DurationVar(&lateness, "lateness", 0, "how late out of order records can arrive before their window is printed (e.g. 30s)")
+	flag.StringVar(&since, "since", "", "skip records whose -time-field is before the provided time. Accepts absolute times, `now` or relative times like `15m ago`")
+	flag.StringVar(&until, "until", "", "skip records whose -time-field is after the provided time. Accepts absolute times, `now` or relative times like `15m ago`")
+	flag.BoolVar(&sorted, "sorted", false, "assume -file is sorted by -time-field, binary searching the lines within -since and -until instead of scanning the whole file")
 	flag.StringVar(&format, "format", "stdout", "format to be used for output, pipelines are printed in order")
 	flag.BoolVar(&help, "help", false, "shows help message")
 	flag.BoolVar(&help, "h", false, "shows help message")
-	flag.BoolVar(&exitOnError, "exit", true, "terminate execution immediately on first pipeline error")
+	flag.BoolVar(&exitOnError, "exit", true, "terminate execution immediately on first pipeline error. -exit=false is the same as -on-error=skip")
+	flag.StringVar(&onError, "on-error", onErrorFail, "what to do when a pipeline fails on a line: fail, skip, log or passthrough (pipeline outputs the unmodified input line)")
+	flag.StringVar(&errorsPath, "errors-file", "", "write a JSON record for every pipeline error to file")
 	flag.IntVar(&mem, "mem", 10, "Buffer size in MB")
+	flag.StringVar(&longLines, "long-lines", longLinesFail, "what to do with lines longer than -mem: fail, skip, truncate or split")
 	flag.IntVar(&workers, "workers", 1, "number of parallel workers (0 = auto, 1 = serial, >1 = parallel with N workers)")
 	flag.IntVar(&queueSize, "queue", 10000, "bounded job queue size for backpressure")
+	flag.IntVar(&contextAfter, "A", 0, "print N lines of context after matching lines")
+	flag.IntVar(&contextBefore, "B", 0, "print N lines of context before matching lines")
+	flag.IntVar(&contextAround, "C", 0, "print N lines of context before and after matching lines")
+	flag.BoolVar(&lineNumbers, "n", false, "add the line number of each record as the __line field")
+	flag.BoolVar(&byteOffsets, "byte-offset", false, "add the byte offset of each record as the __offset field")
+	flag.BoolVar(&countMatches, "count", false, "print the number of matched lines of each pipeline instead of the matches")
+	flag.BoolVar(&quiet, "q", false, "print nothing, exiting on the first match. The exit status is 0 if a line matched, 1 otherwise")
+	flag.Int64Var(&maxCount, "max-count", 0, "stop reading input once N records are printed (0 = unlimited)")
+	flag.BoolVar(&uniqCount, "uniq-count", false, "print each line kept by uniq or uniqby with its number of occurrences once input ends, like uniq -c")
+	flag.BoolVar(&unordered, "unordered", false, "print results as soon as they are processed instead of in input order (parallel mode only)")
+	flag.IntVar(&reorderWindow, "reorder-window", 10000, "max number of lines in flight while waiting for a slower line to be printed in order (parallel mode only)")
 	flag.StringVar(&delimiter, "delimiter", "", "split input into a sequence of lines using a custom delimiter")
 	flag.StringVar(&joinDelimiter, "join", "", "join output using a custom delimiter. Writes to stdout")
 	flag.IntVar(&stdoutBufferSize, "buffer", 0, "flush stdout in batches to increase performance")
@@ -81,7 +138,7 @@ func Run() {
 		parser := NewParser(raw)
 		cmds, err := parser.Parse()
 		if err != nil {
-			log.Fatal(err)
+			fatalf("%v", err)
 		}
 
 		for _, cmd := range cmds {
@@ -92,20 +149,55 @@ func Run() {
 
 		pipelines = append(pipelines, cmds)
 	}
+	setupSort()
 
 	if index != "" {
-		indexPipeline := false
-		for _, name := range pipelineNames {
-			if name == index {
-				indexPipeline = true
+		indexNames = strings.Split(index, ",")
+		for _, name := range indexNames {
+			if !slices.Contains(pipelineNames, name) {
+				fatalf("index `%s` must have a matching named pipeline", name)
 			}
 		}
 
-		if !indexPipeline {
-			log.Fatalf("index `%s` must have a matching named pipeline", index)
-		}
+		parseIndexTimeout(indexTimeout)
+	} else if indexMulti {
+		fatalf("-index-multi requires -index")
+	}
+	if indexMulti && format == "csv" {
+		fatalf("-index-multi cannot be used with -format csv, as repeated values do not fit in a column. Use -format json")
+	}
+
+	if !exitOnError && onError == onErrorFail {
+		onError = onErrorSkip
+	}
+	if !slices.Contains([]string{onErrorFail, onErrorSkip, onErrorLog, onErrorPassthrough}, onError) {
+		fatalf("unknown -on-error policy `%s`", onError)
+	}
+	if errorsPath != "" {
+		openErrorsFile(errorsPath)
+		defer closeErrorsFile()
+	}
+
+	if !slices.Contains([]string{longLinesFail, longLinesSkip, longLinesTruncate, longLinesSplit}, longLines) {
+		fatalf("unknown -long-lines mode `%s`", longLines)
 	}
 
+	if reorderWindow < 1 {
+		fatalf("reorder window must be at least 1, got %d", reorderWindow)
+	}
+
+	setupAggregation()
+	setupUniqCount()
+	setupDeferred()
+	setupHead()
+	setupContext(contextAround)
+	setupFields()
+	validateSortKeys()
+	if err := setupTimeRange(); err != nil {
+		fatalf("%v", err)
+	}
+	compiled = compile(pipelines)
+
 	scanner := bufio.NewScanner(os.Stdin)
 
 	var f *os.File
@@ -113,9 +205,21 @@ func Run() {
 		var err error
 		f, err = os.Open(input)
 		if err != nil {
-			log.Fatalf("failed to open input: %v", err)
+			fatalf("failed to open input: %v", err)
 		}
 		scanner = bufio.NewScanner(f)
+
+		if seekable(f) {
+			start, end, err := seekTimeRange(f)
+			if err != nil {
+				fatalf("failed to seek input: %v", err)
+			}
+			if _, err := f.Seek(start, io.SeekStart); err != nil {
+				fatalf("failed to seek input: %v", err)
+			}
+			scanner = bufio.NewScanner(io.LimitReader(f, end-start))
+			offsets.pos = start
+		}
 	}
 
 	print := handleCustomFormatPrint
@@ -133,15 +237,29 @@ func Run() {
 		print = handleBufferedStdoutPrint
 	}
 
+	if quiet {
+		print = func(record [][]string) {}
+		maxCount = 1
+	}
+
+	// records are sorted within the same memory budget as the scanner,
+	// spilling to temporary files beyond it
+	var recordSorter *sorter
+	sortedPrint := print
+	if sorting() {
+		recordSorter = newSorter(mem * 1024 * 1024)
+		print = recordSorter.printer()
+	}
+
 	usedMem := mem * 1024 * 1024
 	buf := make([]byte, 0, usedMem)
 	scanner.Buffer(buf, usedMem)
 
+	split := bufio.ScanLines
 	if delimiter != "" {
-		scanner.Split(ScanDelimiter(delimiter))
-	} else {
-		scanner.Split(bufio.ScanLines)
+		split = ScanDelimiter(delimiter)
 	}
+	scanner.Split(offsets.Split(ScanLongLines(split, usedMem, longLines)))
 
 	if workers == 1 {
 		syncScan(scanner, print)
@@ -159,22 +277,66 @@ func Run() {
 		parallelScan(ctx, scanner, print)
 	}
 
-	// TODO: should be considered while scanning
-	if err := scanner.Err(); err != nil {
-		log.Printf("scanner error: %v", err)
+	if index != "" {
+		for _, buffered := range flushBuffer() {
+			output(buffered, print)
+		}
+	}
+
+	flushDeferred(print)
+
+	if aggregating() {
+		aggregates.flush(print)
+	}
+
+	if countMatches {
+		printCounts(print)
+	}
+
+	if sorting() {
+		recordSorter.flush(sortedPrint)
 	}
 
 	if stdoutBufferSize > 0 {
 		flushBufferedStdout()
 	}
 
+	// once done, the scanner may still be in
+	// use by the reading goroutine of parallelScan
+	var err error
+	if !done() {
+		err = scanner.Err()
+	}
+	if err == bufio.ErrTooLong {
+		fatalf("line longer than %d MB, increase -mem or use -long-lines to skip, truncate or split it", mem)
+	} else if err != nil {
+		fatalf("scanner error: %v", err)
+	}
+
+	if longLinesCount > 0 {
+		verbs := map[string]string{
+			longLinesSkip:     "skipped",
+			longLinesTruncate: "truncated",
+			longLinesSplit:    "split",
+		}
+		log.Printf("%d lines longer than %d MB were %s", longLinesCount, mem, verbs[longLines])
+	}
+
 	if f != nil {
 		f.Close()
 	}
+
+	if matched == 0 {
+		exit(exitNoMatch)
+	}
 }
 
-func collector(ctx context.Context, resultsCh <-chan Result, print printer) {
-	ordering := make(map[int64][][]string)
+// collector prints results handed back by workers. Unless running unordered,
+// results are printed in input order, holding back early results until
+// all previous lines are printed. Every printed line releases a slot
+// of window, letting the dispatcher send a new line to workers.
+func collector(ctx context.Context, cancel context.CancelFunc, resultsCh <-chan Result, print printer, window <-chan struct{}) {
+	ordering := make(map[int64]Result)
 
 	var seq int64
 	for {
@@ -185,37 +347,181 @@ func collector(ctx context.Context, resultsCh <-chan Result, print printer) {
 			if !ok {
 				return
 			}
-			if result.Err != nil && exitOnError {
-				log.Fatalf("error processing line %d: %v", result.Seq, result.Err)
+			handleErrors(result.Seq, result.Line, result.Errs)
+
+			if unordered {
+				deliver(result, print)
+				<-window
+				if limitDone() {
+					cancel()
+					return
+				}
+				continue
 			}
 
-			ordering[result.Seq] = result.Results
+			ordering[result.Seq] = result
 
 			for {
-				results, exists := ordering[seq]
+				result, exists := ordering[seq]
 				if !exists {
 					break
 				}
 
-				if index == "" {
-					print(results)
-				} else {
-					buffered := buffer(results)
-					if buffered != nil {
-						print(buffered)
-					}
-				}
+				deliver(result, print)
 
 				// clean up to avoid growing memory usage of ordering
 				// buffer in case of many pending pipelines
 				delete(ordering, seq)
 				seq++
+				<-window
+
+				// stop reading input, as no more records will be printed
+				if limitDone() {
+					cancel()
+					return
+				}
 			}
 		}
 	}
 }
 
-func worker(ctx context.Context, jobsCh <-chan Job, resultsCh chan<- Result) {
+// matched counts the records printed, or counted with -count
+var matched int64
+
+// limitReached reports whether -max-count records were printed
+func limitReached() bool {
+	return maxCount > 0 && matched >= maxCount
+}
+
+// limitDone reports whether -max-count records were printed,
+// along with the lines of context after the last one
+func limitDone() bool {
+	return limitReached() && afterLeft == 0
+}
+
+// done reports whether no more records can be printed, so
+// that input can stop being read before reaching its end
+func done() bool {
+	return limitDone() || headsSatisfied()
+}
+
+// pipelineMatches counts the matched lines of each pipeline name with -count
+var pipelineMatches = map[string]int64{}
+
+func countRecord(record [][]string) {
+	counted := map[string]bool{}
+	for _, result := range record {
+		if !counted[result[1]] {
+			pipelineMatches[result[1]]++
+			counted[result[1]] = true
+		}
+	}
+}
+
+// printCounts prints the number of matched lines of each pipeline.
+// Unnamed pipelines are counted together
+func printCounts(print printer) {
+	var record [][]string
+	for _, name := range compiled.names {
+		if !slices.ContainsFunc(record, func(field []string) bool { return field[1] == name }) {
+			record = append(record, []string{strconv.FormatInt(pipelineMatches[name], 10), name})
+		}
+	}
+	if format != "stdout" {
+		print(record)
+		return
+	}
+
+	// stdout has no field names, so like `grep -c` on several
+	// files, each count is printed on its own line after its name
+	for _, field := range record {
+		count, name := field[0], field[1]
+		if name != "" {
+			count = name + ":" + count
+		}
+		print([][]string{{count, name}})
+	}
+}
+
+// deliver emits the results handed back by a worker. Results
+// already aggregated by the worker are only counted as matched
+func deliver(result Result, print printer) {
+	if result.Aggregated {
+		if len(result.Results) > 0 {
+			matched++
+		}
+		return
+	}
+
+	emit(result, print)
+}
+
+// emit prints the results of a single line, aggregating
+// them by index first when configured. Lines out of
+// -since and -until are skipped. With -A, -B or -C,
+// lines around matching ones are printed as well
+func emit(result Result, print printer) {
+	results := result.Results
+	if !inTimeRange(results) {
+		if withContext() {
+			skipContext()
+		}
+		return
+	}
+	results = withFields(results, result.Seq, result.Offset)
+
+	if withContext() {
+		// past -max-count, matching lines are only trailing context
+		if len(results) > 0 && limitReached() {
+			results = nil
+		}
+		if len(results) > 0 {
+			matched++
+		}
+		raw := withFields([][]string{{result.Line, ""}}, result.Seq, result.Offset)
+		printWithContext(raw, results, print)
+		return
+	}
+
+	if index == "" {
+		output(results, print)
+		return
+	}
+
+	for _, buffered := range buffer(results) {
+		output(buffered, print)
+	}
+}
+
+// output prints a record, unless aggregate pipelines are
+// defined. In that case records are only printed as
+// aggregates once input ends. With -count, records
+// are counted rather than printed
+func output(record [][]string, print printer) {
+	if limitReached() {
+		return
+	}
+	if len(record) > 0 {
+		matched++
+	}
+
+	if countMatches {
+		countRecord(record)
+		return
+	}
+
+	if aggregating() {
+		aggregates.add(record, aggregated, print)
+		aggregated++
+		return
+	}
+
+	print(record)
+}
+
+// worker evaluates lines sent by the dispatcher. When agg is not nil,
+// results are aggregated by the worker rather than printed
+func worker(ctx context.Context, jobsCh <-chan Job, resultsCh chan<- Result, agg *aggregation) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -225,29 +531,28 @@ func worker(ctx context.Context, jobsCh <-chan Job, resultsCh chan<- Result) {
 				return
 			}
 
-			var results [][]string
-			for _, pipeline := range pipelines {
-				match, name, err := handle(job.Line, pipeline)
-				if err != nil && exitOnError {
-					resultsCh <- Result{Seq: job.Seq, Results: nil, Err: err}
-					return
-				}
-				if len(match) > 0 {
-					results = append(results, []string{match, name})
-				}
-			}
+			results, errs := compiled.eval(job.Line)
 
 			if len(pipelineNames) > 0 {
 				sortPipelines(results)
 			}
 
-			resultsCh <- Result{Seq: job.Seq, Results: results, Err: nil}
+			if agg != nil {
+				agg.add(results, job.Seq, nil)
+			}
+
+			result := Result{Seq: job.Seq, Line: job.Line, Offset: job.Offset, Results: results, Errs: errs, Aggregated: agg != nil}
+			select {
+			case <-ctx.Done():
+				return
+			case resultsCh <- result:
+			}
 		}
 	}
 }
 
 func sortPipelines(results [][]string) {
-	slices.SortFunc(results, func(a, b []string) int {
+	slices.SortStableFunc(results, func(a, b []string) int {
 		// Unnamed pipelines should be pushed last
 		aIndex := -1
 		bIndex := -1
@@ -269,26 +574,6 @@ func sortPipelines(results [][]string) {
 	})
 }
 
-func handle(line string, cmds []Command) (string, string, error) {
-	cmd := cmds[0]
-
-	match, err := operators[cmd.Name].Operator(line, cmd.Arg)
-	if err != nil {
-		return "", "", err
-	}
-
-	var name string
-	if cmd.Name == "name" {
-		name = cmd.Arg
-	}
-
-	if len(cmds) > 1 {
-		return handle(match, cmds[1:])
-	}
-
-	return match, name, nil
-}
-
 func usage() {
 	fmt.Println("Available commands:")
 	for name, entry := range operators {
@@ -312,34 +597,30 @@ func usage() {
 }
 
 func syncScan(scanner *bufio.Scanner, print printer) {
+	var seq int64
 	for scanner.Scan() {
-		var results [][]string
-		for _, pipeline := range pipelines {
-			match, name, err := handle(scanner.Text(), pipeline)
-			if err != nil && exitOnError {
-				log.Fatalf("error processing line: %v", err)
-			}
-			if len(match) > 0 {
-				results = append(results, []string{match, name})
-			}
-		}
+		line := scanner.Text()
+		results, errs := compiled.eval(line)
+		handleErrors(seq, line, errs)
 
 		if len(pipelineNames) > 0 {
 			sortPipelines(results)
 		}
 
-		if index == "" {
-			print(results)
-		} else {
-			buffered := buffer(results)
-			if buffered != nil {
-				print(buffered)
-			}
+		emit(Result{Seq: seq, Line: line, Offset: offsets.start, Results: results}, print)
+		seq++
+
+		if done() {
+			return
 		}
 	}
 }
 
 func parallelScan(ctx context.Context, scanner *bufio.Scanner, print printer) {
+	// cancelled by the collector once -max-count is reached
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	numWorkers := workers
 	if numWorkers <= 0 {
 		numWorkers = runtime.NumCPU()
@@ -347,30 +628,53 @@ func parallelScan(ctx context.Context, scanner *bufio.Scanner, print printer) {
 
 	jobsCh := make(chan Job, queueSize)
 	resultsCh := make(chan Result, numWorkers*2)
-	linesCh := make(chan string, queueSize)
+	linesCh := make(chan Job, queueSize)
+
+	// window bounds the lines dispatched but not yet printed. When a slow
+	// line holds back printing, workers are starved instead of buffering
+	// an unbounded amount of results in the collector
+	window := make(chan struct{}, reorderWindow)
 
 	go func() {
 		defer close(linesCh)
 		for scanner.Scan() {
-			linesCh <- scanner.Text()
+			select {
+			case <-ctx.Done():
+				return
+			case linesCh <- Job{Line: scanner.Text(), Offset: offsets.start}:
+			}
 		}
 	}()
 
+	// aggregates are mergeable, so workers aggregate on their own
+	// when the outcome does not depend on input order
+	locals := make([]*aggregation, numWorkers)
+	if aggregatingInWorkers() {
+		for i := range locals {
+			locals[i] = newAggregation()
+		}
+	}
+
 	var workersWg sync.WaitGroup
 	for i := 0; i < numWorkers; i++ {
 		workersWg.Go(func() {
-			worker(ctx, jobsCh, resultsCh)
+			worker(ctx, jobsCh, resultsCh, locals[i])
 		})
 	}
 
 	var collectorWg sync.WaitGroup
 	collectorWg.Go(func() {
-		collector(ctx, resultsCh, print)
+		collector(ctx, cancel, resultsCh, print, window)
 	})
 
 	cleanup := func() {
 		close(jobsCh)
 		workersWg.Wait()
+		for _, local := range locals {
+			if local != nil {
+				aggregates.merge(local)
+			}
+		}
 		close(resultsCh)
 		collectorWg.Wait()
 	}
@@ -381,11 +685,28 @@ func parallelScan(ctx context.Context, scanner *bufio.Scanner, print printer) {
 		select {
 		case <-ctx.Done():
 			return
-		case line, ok := <-linesCh:
+		case job, ok := <-linesCh:
 			if !ok {
 				return
 			}
-			jobsCh <- Job{Seq: seq, Line: line}
+
+			select {
+			case <-ctx.Done():
+				return
+			case window <- struct{}{}:
+			}
+
+			// lines in flight are still printed
+			if headsSatisfied() {
+				return
+			}
+
+			job.Seq = seq
+			select {
+			case <-ctx.Done():
+				return
+			case jobsCh <- job:
+			}
 			seq++
 		}
 	}
@@ -0,0 +1,112 @@
+package patman
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRunHelper runs patman in a subprocess started by runPatman,
+// as Run parses flags once and exits with the status being tested
+func TestRunHelper(t *testing.T) {
+	if os.Getenv("PATMAN_HELPER") == "" {
+		t.Skip("only run as a subprocess of runPatman")
+	}
+
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Args = append([]string{"patman"}, args...)
+	Run()
+	os.Exit(0)
+}
+
+// runPatman runs patman with args on input, returning its stdout and exit status
+func runPatman(t *testing.T, input string, args ...string) (string, int) {
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestRunHelper$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "PATMAN_HELPER=1")
+	cmd.Stdin = strings.NewReader(input)
+
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return string(out), exit.ExitCode()
+	}
+	assert.NoError(t, err)
+	return string(out), 0
+}
+
+func TestRun(t *testing.T) {
+	input := "error a\nwarn b\nerror c\ninfo d\n"
+
+	t.Run("Should exit like grep", func(t *testing.T) {
+		out, status := runPatman(t, input, "ml(warn)")
+		assert.Equal(t, "warn b\n", out)
+		assert.Equal(t, 0, status)
+
+		out, status = runPatman(t, input, "ml(panic)")
+		assert.Empty(t, out)
+		assert.Equal(t, exitNoMatch, status)
+
+		_, status = runPatman(t, input, "-on-error", "nope", "ml(warn)")
+		assert.Equal(t, exitError, status)
+
+		_, status = runPatman(t, input, "split(\\s/x)")
+		assert.Equal(t, exitError, status)
+	})
+
+	t.Run("Should print nothing with -q", func(t *testing.T) {
+		out, status := runPatman(t, input, "-q", "ml(error)")
+		assert.Empty(t, out)
+		assert.Equal(t, 0, status)
+
+		_, status = runPatman(t, input, "-q", "ml(panic)")
+		assert.Equal(t, exitNoMatch, status)
+	})
+
+	t.Run("Should count matched lines of each pipeline", func(t *testing.T) {
+		out, status := runPatman(t, input, "-count", "ml(error) |> name(error)", "ml(warn) |> name(warn)", "ml(debug) |> name(debug)")
+		assert.Equal(t, "error:2\nwarn:1\ndebug:0\n", out)
+		assert.Equal(t, 0, status)
+
+		out, _ = runPatman(t, input, "-count", "ml(error)")
+		assert.Equal(t, "2\n", out)
+
+		out, _ = runPatman(t, input, "-count", "-format", "json", "ml(error) |> name(error)", "ml(warn) |> name(warn)")
+		assert.JSONEq(t, `{"error":2,"warn":1}`, out)
+	})
+
+	t.Run("Should stop after -max-count records with parallel workers", func(t *testing.T) {
+		var many strings.Builder
+		for i := 0; i < 200000; i++ {
+			many.WriteString("error line\n")
+		}
+
+		out, status := runPatman(t, many.String(), "-workers", "4", "-max-count", "3", "ml(error)")
+		assert.Equal(t, "error line\nerror line\nerror line\n", out)
+		assert.Equal(t, 0, status)
+
+		out, _ = runPatman(t, many.String(), "-workers", "4", "-unordered", "-max-count", "5", "-count", "ml(error)")
+		assert.Equal(t, "5\n", out)
+	})
+
+	t.Run("Should keep recorded errors when exiting on a fatal error", func(t *testing.T) {
+		errorsPath := filepath.Join(t.TempDir(), "errors.json")
+		_, status := runPatman(t, "one\ntwo\n", "-workers", "1", "-on-error", "skip", "-errors-file", errorsPath,
+			"-format", "json", "m(one) |> split(\\s/x)", "ml(two)")
+		assert.Equal(t, 2, status)
+
+		recorded, err := os.ReadFile(errorsPath)
+		assert.NoError(t, err)
+		assert.Contains(t, string(recorded), `"line":"one"`)
+	})
+}
@@ -0,0 +1,179 @@
+package patman
+
+import "slices"
+
+// substringFilters and regexFilters are operators returning either
+// the whole line or nothing. Adjacent filters commute, so the cheap
+// substring ones are moved ahead of the regexp ones.
+var substringFilters = map[string]bool{
+	"filter":       true,
+	"filterany":    true,
+	"notfilterany": true,
+}
+
+var regexFilters = map[string]bool{
+	"matchline":    true,
+	"notmatchline": true,
+}
+
+// stage is a node of the compiled pipelines tree. Pipelines starting
+// with the same sequence of commands share the corresponding stages,
+// so a common prefix is evaluated once per line, however many
+// pipelines start with it.
+type stage struct {
+	cmd      Command
+	op       operator
+	children []*stage
+
+	// ends holds the indexes of the pipelines terminating at this stage
+	ends []int
+
+	// pipelines holds the indexes of all pipelines going through this stage
+	pipelines []int
+}
+
+type plan struct {
+	root *stage
+
+	// names holds the name of each pipeline, empty when unnamed
+	names []string
+}
+
+// compile builds the stages tree out of the parsed pipelines
+func compile(pipelines [][]Command) *plan {
+	p := &plan{root: &stage{}}
+
+	for i, cmds := range pipelines {
+		cmds = reorder(cmds)
+
+		var name string
+		if last := cmds[len(cmds)-1]; last.Name == "name" {
+			name = last.Arg
+		}
+		p.names = append(p.names, name)
+
+		current := p.root
+		for _, cmd := range cmds {
+			current = current.child(cmd)
+			current.pipelines = append(current.pipelines, i)
+		}
+		current.ends = append(current.ends, i)
+	}
+
+	return p
+}
+
+// child returns the stage evaluating cmd after s, creating it when missing.
+// Stateful operators always get a stage of their own, as sharing them
+// would leak state between pipelines
+func (s *stage) child(cmd Command) *stage {
+	entry := operators[cmd.Name]
+	key := canonical(cmd.Name)
+
+	if !entry.Stateful {
+		for _, child := range s.children {
+			if canonical(child.cmd.Name) == key && child.cmd.Arg == cmd.Arg && !operators[child.cmd.Name].Stateful {
+				return child
+			}
+		}
+	}
+
+	child := &stage{cmd: cmd, op: entry.Operator}
+	if entry.New != nil {
+		child.op = entry.New(cmd.Arg)
+	}
+	s.children = append(s.children, child)
+	return child
+}
+
+// canonical resolves operator aliases, so that e.g. `ml(a)` and
+// `matchline(a)` are recognized as the same stage
+func canonical(name string) string {
+	for canonicalName, entry := range operators {
+		if entry.Alias == name {
+			return canonicalName
+		}
+	}
+	return name
+}
+
+// reorder moves substring filters ahead of regexp filters within each
+// run of adjacent filters. Order across other operators is preserved,
+// as they may transform the line.
+func reorder(cmds []Command) []Command {
+	cost := func(cmd Command) int {
+		if substringFilters[canonical(cmd.Name)] {
+			return 0
+		}
+		return 1
+	}
+
+	reordered := slices.Clone(cmds)
+	for start := 0; start < len(reordered); {
+		end := start
+		for end < len(reordered) && isFilter(reordered[end]) {
+			end++
+		}
+		if end == start {
+			start++
+			continue
+		}
+
+		slices.SortStableFunc(reordered[start:end], func(a, b Command) int {
+			return cost(a) - cost(b)
+		})
+		start = end
+	}
+
+	return reordered
+}
+
+func isFilter(cmd Command) bool {
+	name := canonical(cmd.Name)
+	return substringFilters[name] || regexFilters[name]
+}
+
+// eval runs line through all pipelines, returning a [match, name]
+// pair for every pipeline producing a non-empty match, in pipelines order.
+// A failing stage fails all pipelines going through it. Their match
+// is empty, unless the -on-error policy is passthrough, in which case
+// they match the whole input line.
+func (p *plan) eval(line string) ([][]string, []pipelineError) {
+	matches := make([]string, len(p.names))
+
+	var errs []pipelineError
+	var walk func(s *stage, input string)
+	walk = func(s *stage, input string) {
+		for _, child := range s.children {
+			match, err := child.op(input, child.cmd.Arg)
+			if err != nil {
+				for _, i := range child.pipelines {
+					errs = append(errs, pipelineError{Pipeline: i, Stage: child.cmd, Err: err})
+					if onError == onErrorPassthrough {
+						matches[i] = line
+					}
+				}
+				continue
+			}
+
+			for _, i := range child.ends {
+				matches[i] = match
+			}
+			walk(child, match)
+		}
+	}
+	walk(p.root, line)
+
+	var results [][]string
+	for i, match := range matches {
+		if len(match) > 0 {
+			results = append(results, []string{match, p.names[i]})
+		}
+	}
+
+	slices.SortFunc(errs, func(a, b pipelineError) int {
+		return a.Pipeline - b.Pipeline
+	})
+
+	return results, errs
+}
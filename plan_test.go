@@ -0,0 +1,115 @@
+package patman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParse(t *testing.T, code string) []Command {
+	cmds, err := NewParser(code).Parse()
+	assert.NoError(t, err)
+	return cmds
+}
+
+func TestPlan(t *testing.T) {
+	t.Run("Should share common prefixes across pipelines", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, "filter(payment) |> match(\\d+) |> name(amount)"),
+			mustParse(t, "f(payment) |> match(user=\\w+) |> name(user)"),
+			mustParse(t, "ml(ERROR) |> name(error)"),
+		})
+
+		assert.Len(t, p.root.children, 2)
+		assert.Len(t, p.root.children[0].children, 2)
+		assert.Equal(t, []string{"amount", "user", "error"}, p.names)
+	})
+
+	t.Run("Should evaluate pipelines in order", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, "filter(payment) |> match(\\d+) |> name(amount)"),
+			mustParse(t, "filter(payment) |> match(user=\\w+) |> name(user)"),
+			mustParse(t, "ml(ERROR) |> name(error)"),
+		})
+
+		results, errs := p.eval("payment user=lara 42")
+		assert.Empty(t, errs)
+		assert.Equal(t, [][]string{{"42", "amount"}, {"user=lara", "user"}}, results)
+
+		results, errs = p.eval("ERROR refund user=lara")
+		assert.Empty(t, errs)
+		assert.Equal(t, [][]string{{"ERROR refund user=lara", "error"}}, results)
+	})
+
+	t.Run("Should move substring filters ahead of regexp filters", func(t *testing.T) {
+		cmds := reorder(mustParse(t, "ml(ERROR.*) |> filter(payment) |> replace(a/b) |> nml(x) |> fa(c,d)"))
+
+		var names []string
+		for _, cmd := range cmds {
+			names = append(names, cmd.Name)
+		}
+		assert.Equal(t, []string{"filter", "ml", "replace", "fa", "nml"}, names)
+	})
+
+	t.Run("Should fail all pipelines going through a failing stage", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, "split(\\s/x) |> name(first)"),
+			mustParse(t, "split(\\s/x) |> match(a) |> name(second)"),
+			mustParse(t, "match(a) |> name(third)"),
+		})
+
+		results, errs := p.eval("a b")
+		assert.Equal(t, [][]string{{"a", "third"}}, results)
+		assert.Len(t, errs, 2)
+		assert.Equal(t, 0, errs[0].Pipeline)
+		assert.Equal(t, 1, errs[1].Pipeline)
+		assert.Equal(t, "split", errs[1].Stage.Name)
+	})
+
+	t.Run("Should not share stateful stages", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, "filter(a) |> uniq(_) |> name(first)"),
+			mustParse(t, "filter(a) |> uniq(_) |> name(second)"),
+		})
+
+		assert.Len(t, p.root.children, 1)
+		assert.Len(t, p.root.children[0].children, 2)
+	})
+
+	t.Run("Should keep uniq state per pipeline", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, "uniq(_) |> name(first)"),
+			mustParse(t, "uniq(_) |> name(second)"),
+		})
+
+		results, _ := p.eval("a")
+		assert.Equal(t, [][]string{{"a", "first"}, {"a", "second"}}, results)
+
+		results, _ = p.eval("a")
+		assert.Empty(t, results)
+	})
+
+	t.Run("Should skip empty filterany patterns", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, "fa(a,) |> name(any)"),
+			mustParse(t, "nfa(a,) |> name(none)"),
+		})
+
+		results, _ := p.eval("xyz")
+		assert.Equal(t, [][]string{{"xyz", "none"}}, results)
+
+		results, _ = p.eval("abc")
+		assert.Equal(t, [][]string{{"abc", "any"}}, results)
+	})
+
+	t.Run("Should share filterany stages across pipelines", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, "fa(a,b) |> name(first)"),
+			mustParse(t, "filterany(a,b) |> match(b) |> name(second)"),
+		})
+
+		assert.Len(t, p.root.children, 1)
+		results, _ := p.eval("ab")
+		assert.Equal(t, [][]string{{"ab", "first"}, {"b", "second"}}, results)
+	})
+}
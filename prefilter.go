@@ -0,0 +1,118 @@
+package patman
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
+)
+
+// maxLiterals caps how many required literals are checked before
+// falling back to the regexp engine. Longest literals are the most
+// selective, checking many short ones costs more than it saves
+const maxLiterals = 3
+
+// prefiltered is a compiled regexp carrying the literal substrings
+// every match must contain. Lines lacking any of them are rejected
+// with a plain substring search, without running the regexp engine.
+// e.g. `ERROR.*timeout` -> ["timeout", "ERROR"]
+type prefiltered struct {
+	*regexp.Regexp
+	literals []string
+}
+
+func newPrefiltered(re *regexp.Regexp) *prefiltered {
+	p := &prefiltered{Regexp: re}
+
+	tree, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return p
+	}
+
+	p.literals = requiredLiterals(tree.Simplify())
+	return p
+}
+
+// requiredLiterals walks the regexp syntax tree collecting literals
+// that must appear in any matching string. Optional branches, alternations
+// and case-insensitive literals cannot be required, so they are skipped.
+func requiredLiterals(re *syntax.Regexp) []string {
+	var literals []string
+
+	var walk func(re *syntax.Regexp)
+	walk = func(re *syntax.Regexp) {
+		switch re.Op {
+		case syntax.OpLiteral:
+			if re.Flags&syntax.FoldCase == 0 && len(re.Rune) > 0 {
+				literals = append(literals, string(re.Rune))
+			}
+		case syntax.OpCapture, syntax.OpPlus:
+			walk(re.Sub[0])
+		case syntax.OpRepeat:
+			if re.Min > 0 {
+				walk(re.Sub[0])
+			}
+		case syntax.OpConcat:
+			for _, sub := range re.Sub {
+				walk(sub)
+			}
+		}
+	}
+	walk(re)
+
+	slices.SortFunc(literals, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+	literals = slices.Compact(literals)
+	if len(literals) > maxLiterals {
+		literals = literals[:maxLiterals]
+	}
+
+	return literals
+}
+
+// mayMatch reports whether s contains all required literals.
+// A false result guarantees the regexp does not match s
+func (p *prefiltered) mayMatch(s string) bool {
+	for _, literal := range p.literals {
+		if strings.Index(s, literal) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *prefiltered) MatchString(s string) bool {
+	return p.mayMatch(s) && p.Regexp.MatchString(s)
+}
+
+func (p *prefiltered) FindString(s string) string {
+	if !p.mayMatch(s) {
+		return ""
+	}
+	return p.Regexp.FindString(s)
+}
+
+func (p *prefiltered) FindAllString(s string, n int) []string {
+	if !p.mayMatch(s) {
+		return nil
+	}
+	return p.Regexp.FindAllString(s, n)
+}
+
+func (p *prefiltered) FindStringSubmatch(s string) []string {
+	if !p.mayMatch(s) {
+		return nil
+	}
+	return p.Regexp.FindStringSubmatch(s)
+}
+
+func (p *prefiltered) ReplaceAllString(src, repl string) string {
+	if !p.mayMatch(src) {
+		return src
+	}
+	return p.Regexp.ReplaceAllString(src, repl)
+}
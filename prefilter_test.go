@@ -0,0 +1,50 @@
+package patman
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefilter(t *testing.T) {
+	t.Run("Should extract required literals from concatenations", func(t *testing.T) {
+		p := newPrefiltered(regexp.MustCompile(`ERROR.*timeout`))
+		assert.Equal(t, []string{"timeout", "ERROR"}, p.literals)
+	})
+
+	t.Run("Should extract literals from captures and repetitions", func(t *testing.T) {
+		p := newPrefiltered(regexp.MustCompile(`(user=\w+)+ id:\d+`))
+		assert.Equal(t, []string{"user=", " id:"}, p.literals)
+	})
+
+	t.Run("Should skip optional, alternated and case insensitive literals", func(t *testing.T) {
+		assert.Empty(t, newPrefiltered(regexp.MustCompile(`(warn)?`)).literals)
+		assert.Empty(t, newPrefiltered(regexp.MustCompile(`warn|error`)).literals)
+		assert.Empty(t, newPrefiltered(regexp.MustCompile(`(?i)error`)).literals)
+		assert.Empty(t, newPrefiltered(regexp.MustCompile(`(abc)*`)).literals)
+	})
+
+	t.Run("Should keep only the longest literals", func(t *testing.T) {
+		p := newPrefiltered(regexp.MustCompile(`a.bb.ccc.dddd`))
+		assert.Equal(t, []string{"dddd", "ccc", "bb"}, p.literals)
+	})
+
+	t.Run("Should behave like the wrapped regexp", func(t *testing.T) {
+		re := regexp.MustCompile(`ERROR (\d+) timeout`)
+		p := newPrefiltered(re)
+
+		lines := []string{
+			"ERROR 42 timeout",
+			"INFO 42 timeout",
+			"ERROR timeout",
+			"",
+		}
+		for _, line := range lines {
+			assert.Equal(t, re.MatchString(line), p.MatchString(line), line)
+			assert.Equal(t, re.FindString(line), p.FindString(line), line)
+			assert.Equal(t, re.FindStringSubmatch(line), p.FindStringSubmatch(line), line)
+			assert.Equal(t, re.ReplaceAllString(line, "x"), p.ReplaceAllString(line, "x"), line)
+		}
+	})
+}
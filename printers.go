@@ -25,17 +25,25 @@ func RegisterPrinter(name string, p printer) {
 
 var csvWriter *csv.Writer
 
+// columns is the csv header when printing records
+// not shaped after the pipelines, e.g. aggregates
+var columns []string
+
 // BUG: should print delimiter also when there's no match
 func handleCsvPrint(results [][]string) {
 	if len(pipelineNames) != len(pipelines) {
 		// TODO: better error
 		fmt.Println("all pipelines must be named")
-		os.Exit(1)
+		exit(exitError)
 	}
 
 	if csvWriter == nil {
 		csvWriter = csv.NewWriter(os.Stdout)
-		csvWriter.Write(pipelineNames)
+		if columns != nil {
+			csvWriter.Write(columns)
+		} else {
+			csvWriter.Write(pipelineNames)
+		}
 	}
 
 	empty := true
@@ -64,19 +72,28 @@ func handleJsonPrint(results [][]string) {
 		if name == "" {
 			// TODO: This error should happen before parsing?
 			fmt.Println("cannot set json without named pipeline")
-			os.Exit(1)
+			exit(exitError)
+		}
+
+		// repeated records of an index group are collected in arrays
+		path := name
+		if indexMulti && !isIndex(name) {
+			if match == "" {
+				continue
+			}
+			path = name + ".-1"
 		}
 
 		// interpret all digit strings as numbers
 		// for friendlier json serialization
 		if matchDigits.MatchString(match) {
 			num, _ := strconv.ParseFloat(match, 64)
-			json, _ = sjson.Set(json, name, num)
+			json, _ = sjson.Set(json, path, num)
 			continue
 		}
 
 		if match != "" {
-			json, _ = sjson.Set(json, name, match)
+			json, _ = sjson.Set(json, path, match)
 		}
 	}
 	if json != "{}" {
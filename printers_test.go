@@ -0,0 +1,47 @@
+package patman
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// captureStdout returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+	w.Close()
+
+	out, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(out)
+}
+
+func TestJsonPrint(t *testing.T) {
+	t.Run("Should print repeated pipelines of index groups as arrays", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a", "b"}, []string{"id"})
+		indexMulti = true
+
+		out := captureStdout(t, func() {
+			handleJsonPrint([][]string{{"1", "id"}, {"x", "a"}, {"z", "a"}, {"", "b"}})
+		})
+		assert.JSONEq(t, `{"id":1,"a":["x","z"]}`, out)
+	})
+
+	t.Run("Should print single values without -index-multi", func(t *testing.T) {
+		resetBuffer(t, []string{"id", "a"}, []string{"id"})
+
+		out := captureStdout(t, func() {
+			handleJsonPrint([][]string{{"1", "id"}, {"x", "a"}})
+		})
+		assert.JSONEq(t, `{"id":1,"a":"x"}`, out)
+	})
+}
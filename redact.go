@@ -0,0 +1,216 @@
+package patman
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// piiPattern finds candidates of a kind of personal data.
+// valid, when set, rejects candidates that only look like it,
+// e.g. digit runs failing the Luhn check are not cards.
+// bounded rejects candidates glued to word characters or colons,
+// which \b cannot express for patterns starting or ending with `:`
+type piiPattern struct {
+	re      *regexp.Regexp
+	valid   func(match string) bool
+	bounded bool
+}
+
+var piiPatterns = map[string][]piiPattern{
+	"email": {
+		{re: regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}`)},
+	},
+	"ip": {
+		{re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\b`)},
+		{
+			re:      regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}`),
+			valid:   func(match string) bool { return strings.Count(match, ":") > 1 && net.ParseIP(match) != nil },
+			bounded: true,
+		},
+	},
+	"card": {
+		{re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: luhn},
+	},
+	"phone": {
+		{re: regexp.MustCompile(`\+\d{1,3}[ .-]?(?:\(\d{1,4}\)[ .-]?)?\d{2,4}(?:[ .-]?\d{2,4}){1,3}\b`)},
+		{re: regexp.MustCompile(`(?:\(\d{2,4}\)[ .-]?|\b\d{2,4}[ .-])\d{3,4}[ .-]\d{3,4}\b`)},
+	},
+}
+
+// luhn reports whether the digits of value pass the Luhn checksum
+func luhn(value string) bool {
+	sum, double := 0, false
+	for i := len(value) - 1; i >= 0; i-- {
+		c := value[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// replacePII replaces the matches of kind, which is either a known kind
+// of personal data or a regex, using replace
+func replacePII(line, kind string, replace func(match string) string) string {
+	patterns, ok := piiPatterns[kind]
+	if !ok {
+		return regex(kind).ReplaceAllStringFunc(line, replace)
+	}
+
+	for _, p := range patterns {
+		var b strings.Builder
+		last := 0
+		for _, loc := range p.re.FindAllStringIndex(line, -1) {
+			match := line[loc[0]:loc[1]]
+			if p.valid != nil && !p.valid(match) {
+				continue
+			}
+			if p.bounded && !(isBoundary(line, loc[0]-1) && isBoundary(line, loc[1])) {
+				continue
+			}
+			b.WriteString(line[last:loc[0]])
+			b.WriteString(replace(match))
+			last = loc[1]
+		}
+		b.WriteString(line[last:])
+		line = b.String()
+	}
+	return line
+}
+
+// isBoundary reports whether the byte of line at i, if any, can delimit
+// a match. Word characters and colons cannot, e.g. `d::` in `std::vector`
+func isBoundary(line string, i int) bool {
+	if i < 0 || i >= len(line) {
+		return true
+	}
+	c := line[i]
+	isWord := c == '_' || c == ':' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	return !isWord
+}
+
+// handleRedact masks personal data. Known kinds can be combined
+// with commas, any other argument is a regex.
+// e.g. `email`, `ip,card`, `user=\w+`
+func handleRedact(line, arg string) (string, error) {
+	kinds := strings.Split(arg, ",")
+	for _, kind := range kinds {
+		if _, ok := piiPatterns[kind]; !ok {
+			return replacePII(line, arg, func(string) string { return "[REDACTED]" }), nil
+		}
+	}
+
+	for _, kind := range kinds {
+		mask := "[" + strings.ToUpper(kind) + "]"
+		line = replacePII(line, kind, func(string) string { return mask })
+	}
+	return line, nil
+}
+
+var keyCache = sync.Map{} // map[string][]byte
+
+// readKey reads the HMAC key stored in path once per run.
+// A trailing newline is not part of the key
+func readKey(path string) ([]byte, error) {
+	if cached, ok := keyCache.Load(path); ok {
+		return cached.([]byte), nil
+	}
+
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key: %w", err)
+	}
+	key = []byte(strings.TrimRight(string(key), "\r\n"))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key file `%s` is empty", path)
+	}
+
+	keyCache.Store(path, key)
+	return key, nil
+}
+
+var keyfileCache = sync.Map{} // map[string][2]string
+
+// splitKeyfile splits pattern/keyfile at the first slash followed by an
+// existing file, so keyfiles can be paths, e.g. `email//etc/patman.key`.
+// Otherwise it splits at the last slash, as Args does
+func splitKeyfile(arg string) (string, string) {
+	if cached, ok := keyfileCache.Load(arg); ok {
+		parts := cached.([2]string)
+		return parts[0], parts[1]
+	}
+
+	cmds := Args(arg)
+	parts := [2]string{cmds[0], cmds[1]}
+	for i, c := range arg {
+		if c != '/' {
+			continue
+		}
+		if info, err := os.Stat(arg[i+1:]); err == nil && !info.IsDir() {
+			parts = [2]string{arg[:i], arg[i+1:]}
+			break
+		}
+	}
+
+	keyfileCache.Store(arg, parts)
+	return parts[0], parts[1]
+}
+
+func hmacHex(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// handlePseudonymize replaces the matches of a regex, or of a kind known
+// by redact, with a token derived from their HMAC. Tokens only depend on
+// the key, so the same value maps to the same token across files and runs.
+// e.g. `email/secret.key`, `user=\w+/secret.key`
+func handlePseudonymize(line, arg string) (string, error) {
+	pattern, keyfile := splitKeyfile(arg)
+
+	key, err := readKey(keyfile)
+	if err != nil {
+		return "", err
+	}
+
+	return replacePII(line, pattern, func(match string) string {
+		return "tok_" + hmacHex(key, match)[:16]
+	}), nil
+}
+
+func handleSha256(line, arg string) (string, error) {
+	if line == "" {
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// handleHmac computes the HMAC-SHA256 of the line using the key stored in arg
+func handleHmac(line, arg string) (string, error) {
+	if line == "" {
+		return "", nil
+	}
+	key, err := readKey(arg)
+	if err != nil {
+		return "", err
+	}
+	return hmacHex(key, line), nil
+}
@@ -0,0 +1,69 @@
+package patman
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	t.Run("Should mask known kinds of personal data", func(t *testing.T) {
+		line := "ann@x.com from 10.0.0.1 and fe80::1 at 12:30:45 paid 4111 1111 1111 1111 order 1234567890123 call +1 415 555 2671"
+		out, err := handleRedact(line, "email,ip,card,phone")
+		assert.NoError(t, err)
+		assert.Equal(t, "[EMAIL] from [IP] and [IP] at 12:30:45 paid [CARD] order 1234567890123 call [PHONE]", out)
+	})
+
+	t.Run("Should not mask IPv6 lookalikes glued to words", func(t *testing.T) {
+		line := "std::vector Foo::Bar xfe80::1 at [::1]:80 and fe80::1%eth0"
+		out, err := handleRedact(line, "ip")
+		assert.NoError(t, err)
+		assert.Equal(t, "std::vector Foo::Bar xfe80::1 at [[IP]]:80 and [IP]%eth0", out)
+	})
+
+	t.Run("Should mask matches of a custom regex", func(t *testing.T) {
+		out, err := handleRedact("user=ann id=1", `user=\w+`)
+		assert.NoError(t, err)
+		assert.Equal(t, "[REDACTED] id=1", out)
+	})
+
+	t.Run("Should pseudonymize with stable tokens", func(t *testing.T) {
+		keyfile := filepath.Join(t.TempDir(), "secret.key")
+		assert.NoError(t, os.WriteFile(keyfile, []byte("k3y\n"), 0o600))
+
+		first, err := handlePseudonymize("ann@x.com bob@x.com ann@x.com", "email/"+keyfile)
+		assert.NoError(t, err)
+		tokens := strings.Fields(first)
+		assert.Equal(t, "tok_ec62944869a640aa", tokens[0])
+		assert.Equal(t, tokens[0], tokens[2])
+		assert.NotEqual(t, tokens[0], tokens[1])
+
+		_, err = handlePseudonymize("ann@x.com", "email/missing.key")
+		assert.Error(t, err)
+	})
+
+	t.Run("Should hash lines", func(t *testing.T) {
+		keyfile := filepath.Join(t.TempDir(), "secret.key")
+		assert.NoError(t, os.WriteFile(keyfile, []byte("k3y"), 0o600))
+
+		sum, _ := handleSha256("hello", "_")
+		assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", sum)
+
+		mac, _ := handleHmac("ann@x.com", keyfile)
+		assert.Equal(t, "ec62944869a640aae4ac55f09dd57e081cc0e240cf8acc71160b00aa01fbe6f6", mac)
+	})
+
+	t.Run("Should not hash empty lines", func(t *testing.T) {
+		p := compile([][]Command{
+			mustParse(t, "ml(zzz) |> sha256(_) |> name(sum)"),
+			mustParse(t, "ml(zzz) |> hmac(missing.key) |> name(mac)"),
+		})
+
+		results, errs := p.eval("hello")
+		assert.Empty(t, errs)
+		assert.Empty(t, results)
+	})
+}
@@ -0,0 +1,239 @@
+package patman
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sampling operators keep their state per pipeline. They see lines in the
+// order they are processed, which is input order unless running with
+// multiple -workers. Empty lines, filtered out by previous
+// stages, are not counted
+
+// parseCount parses the positive integer argument of op
+func parseCount(op, arg string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || n < 1 {
+		fatalf("`%s` is not a valid number of lines for %s", arg, op)
+	}
+	return n
+}
+
+// parseSeed parses an optional seed, defaulting to a random one
+func parseSeed(op, arg string) *rand.Rand {
+	if arg == "" {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	seed, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+	if err != nil {
+		fatalf("`%s` is not a valid seed for %s", arg, op)
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// newSample keeps each line with probability p. A seed can be
+// provided for reproducible samples, e.g. `0.01` or `0.01/42`
+func newSample(arg string) operator {
+	rate, seed, _ := strings.Cut(arg, "/")
+	p, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+	if err != nil || p <= 0 || p > 1 {
+		fatalf("`%s` is not a valid sample rate, must be within (0, 1]", rate)
+	}
+	r := parseSeed("sample", seed)
+
+	var mu sync.Mutex
+	return func(line, arg string) (string, error) {
+		if line == "" {
+			return "", nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Float64() < p {
+			return line, nil
+		}
+		return "", nil
+	}
+}
+
+// newEvery keeps one line every n, starting from the first one
+func newEvery(arg string) operator {
+	n := parseCount("every", arg)
+
+	var mu sync.Mutex
+	var seen int
+	return func(line, arg string) (string, error) {
+		if line == "" {
+			return "", nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		seen++
+		if (seen-1)%n == 0 {
+			return line, nil
+		}
+		return "", nil
+	}
+}
+
+// heads holds the head stages of the compiled plan
+var heads []*headStage
+
+// headLimited is set when every pipeline has a head stage, so that
+// input can stop being read once all of them are satisfied
+var headLimited bool
+
+type headStage struct {
+	mu   sync.Mutex
+	n    int
+	seen int
+}
+
+// newHead keeps the first n lines
+func newHead(arg string) operator {
+	h := &headStage{n: parseCount("head", arg)}
+	heads = append(heads, h)
+
+	return func(line, arg string) (string, error) {
+		if line == "" {
+			return "", nil
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if h.seen >= h.n {
+			return "", nil
+		}
+		h.seen++
+		return line, nil
+	}
+}
+
+func (h *headStage) satisfied() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seen >= h.n
+}
+
+// setupHead checks whether every pipeline is limited by head
+func setupHead() {
+	headLimited = len(pipelines) > 0
+	for _, cmds := range pipelines {
+		if !slices.ContainsFunc(cmds, func(cmd Command) bool { return canonical(cmd.Name) == "head" }) {
+			headLimited = false
+		}
+	}
+}
+
+// headsSatisfied reports whether no pipeline can produce more records,
+// as all of them already passed the lines allowed by their head
+func headsSatisfied() bool {
+	if !headLimited {
+		return false
+	}
+	for _, h := range heads {
+		if !h.satisfied() {
+			return false
+		}
+	}
+	return true
+}
+
+// tailStage keeps the last n lines in a ring buffer
+type tailStage struct {
+	mu    sync.Mutex
+	lines []string
+	start int
+	n     int
+}
+
+// newTail holds back lines, printing the last n once input ends
+func newTail(arg string) operator {
+	t := &tailStage{n: parseCount("tail", arg)}
+	deferredStages = append(deferredStages, t)
+
+	return func(line, arg string) (string, error) {
+		if line == "" {
+			return "", nil
+		}
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if len(t.lines) < t.n {
+			t.lines = append(t.lines, line)
+			return "", nil
+		}
+		t.lines[t.start] = line
+		t.start = (t.start + 1) % t.n
+		return "", nil
+	}
+}
+
+func (t *tailStage) records(name string) [][][]string {
+	var records [][][]string
+	for i := range t.lines {
+		records = append(records, [][]string{{t.lines[(t.start+i)%len(t.lines)], name}})
+	}
+	return records
+}
+
+type sampledLine struct {
+	seq  int
+	line string
+}
+
+// reservoirStage keeps a uniform sample of k lines (Vitter, algorithm R)
+type reservoirStage struct {
+	mu     sync.Mutex
+	r      *rand.Rand
+	k      int
+	seen   int
+	sample []sampledLine
+}
+
+// newReservoir holds back lines, printing a uniform sample of k of them
+// once input ends, in input order. A seed can be provided for
+// reproducible samples, e.g. `100` or `100/42`
+func newReservoir(arg string) operator {
+	k, seed, _ := strings.Cut(arg, "/")
+	s := &reservoirStage{k: parseCount("reservoir", k), r: parseSeed("reservoir", seed)}
+	deferredStages = append(deferredStages, s)
+
+	return func(line, arg string) (string, error) {
+		if line == "" {
+			return "", nil
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.seen++
+		if len(s.sample) < s.k {
+			s.sample = append(s.sample, sampledLine{seq: s.seen, line: line})
+			return "", nil
+		}
+		if i := s.r.Intn(s.seen); i < s.k {
+			s.sample[i] = sampledLine{seq: s.seen, line: line}
+		}
+		return "", nil
+	}
+}
+
+func (s *reservoirStage) records(name string) [][][]string {
+	slices.SortFunc(s.sample, func(a, b sampledLine) int { return a.seq - b.seq })
+
+	var records [][][]string
+	for _, sampled := range s.sample {
+		records = append(records, [][]string{{sampled.line, name}})
+	}
+	return records
+}
@@ -0,0 +1,47 @@
+package patman
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampling(t *testing.T) {
+	defer func() { deferredStages, heads = nil, nil }()
+
+	run := func(op operator, n int) []string {
+		var kept []string
+		for i := 1; i <= n; i++ {
+			if out, _ := op(strconv.Itoa(i), ""); out != "" {
+				kept = append(kept, out)
+			}
+		}
+		return kept
+	}
+
+	t.Run("Should keep every nth line", func(t *testing.T) {
+		assert.Equal(t, []string{"1", "4", "7", "10"}, run(newEvery("3"), 10))
+	})
+
+	t.Run("Should keep the first lines", func(t *testing.T) {
+		assert.Equal(t, []string{"1", "2"}, run(newHead("2"), 10))
+		assert.True(t, heads[len(heads)-1].satisfied())
+	})
+
+	t.Run("Should print the last lines once input ends", func(t *testing.T) {
+		assert.Empty(t, run(newTail("3"), 10))
+		records := deferredStages[len(deferredStages)-1].records("last")
+		assert.Equal(t, [][][]string{{{"8", "last"}}, {{"9", "last"}}, {{"10", "last"}}}, records)
+	})
+
+	t.Run("Should sample reproducibly with a seed", func(t *testing.T) {
+		first := run(newSample("0.1/42"), 10000)
+		assert.Equal(t, first, run(newSample("0.1/42"), 10000))
+		assert.InDelta(t, 1000, len(first), 100)
+
+		assert.Empty(t, run(newReservoir("5/42"), 1000))
+		records := deferredStages[len(deferredStages)-1].records("r")
+		assert.Len(t, records, 5)
+	})
+}
@@ -1,6 +1,9 @@
 package patman
 
-import "bytes"
+import (
+	"bufio"
+	"bytes"
+)
 
 func dropDelimiter(data []byte, delim []byte) []byte {
 	if bytes.HasSuffix(data, delim) {
@@ -29,3 +32,94 @@ func ScanDelimiter(delimiter string) func(data []byte, atEOF bool) (advance int,
 		return 0, nil, nil
 	}
 }
+
+const (
+	longLinesFail     = "fail"
+	longLinesSkip     = "skip"
+	longLinesTruncate = "truncate"
+	longLinesSplit    = "split"
+)
+
+// longLinesCount counts the lines exceeding the scanner buffer
+var longLinesCount int
+
+// ScanLongLines wraps a split function, handling lines that do not fit in a
+// buffer of size bytes instead of stopping the scan with bufio.ErrTooLong.
+// Depending on mode, oversized lines are skipped, truncated to size, or
+// split in chunks of size bytes. In fail mode the scan stops as usual.
+func ScanLongLines(split bufio.SplitFunc, size int, mode string) bufio.SplitFunc {
+	// discarding is set while dropping the remainder of an oversized line
+	discarding := false
+	// continuing is set while emitting chunks of an oversized line
+	continuing := false
+
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = split(data, atEOF)
+		if err != nil || advance > 0 || token != nil {
+			if discarding {
+				// tail of an oversized line, already accounted for
+				discarding = false
+				return advance, nil, err
+			}
+			if continuing && len(token) == 0 {
+				// the oversized line ended right at a chunk boundary,
+				// only its delimiter is left
+				continuing = false
+				return advance, nil, err
+			}
+			continuing = false
+			return advance, token, err
+		}
+
+		// Request more data, unless the buffer is full
+		if len(data) < size {
+			return 0, nil, nil
+		}
+
+		if discarding {
+			return len(data), nil, nil
+		}
+
+		if !continuing {
+			longLinesCount++
+		}
+
+		switch mode {
+		case longLinesSkip:
+			discarding = true
+			return len(data), nil, nil
+		case longLinesTruncate:
+			discarding = true
+			return len(data), data, nil
+		case longLinesSplit:
+			continuing = true
+			return len(data), data, nil
+		}
+
+		return 0, nil, bufio.ErrTooLong
+	}
+}
+
+// offsetTracker tracks the byte offset of the tokens of a split function
+type offsetTracker struct {
+	// pos is the offset of the data passed to the split function
+	pos int64
+	// start is the offset of the last token
+	start int64
+}
+
+// offsets tracks the offset of scanned lines. It is moved
+// ahead when the input is seeked to -since
+var offsets = &offsetTracker{}
+
+// Split wraps a split function, recording the offset of each token
+func (o *offsetTracker) Split(split bufio.SplitFunc) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = split(data, atEOF)
+		if token != nil {
+			o.start = o.pos
+		}
+		o.pos += int64(advance)
+		return advance, token, err
+	}
+}
@@ -0,0 +1,79 @@
+package patman
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	t.Run("Should track the offset of each line", func(t *testing.T) {
+		tracker := &offsetTracker{}
+		scanner := bufio.NewScanner(strings.NewReader("a\nfoo bar\r\n\nlast"))
+		scanner.Split(tracker.Split(bufio.ScanLines))
+
+		var starts []int64
+		for scanner.Scan() {
+			starts = append(starts, tracker.start)
+		}
+		assert.Equal(t, []int64{0, 2, 11, 12}, starts)
+	})
+}
+
+// scanLongLines scans input one byte per read, so that lines are split across
+// buffer refills, returning the scanned lines and the number of long lines
+func scanLongLines(input string, size int, mode string) ([]string, int, error) {
+	longLinesCount = 0
+	defer func() { longLinesCount = 0 }()
+
+	scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(input)))
+	scanner.Buffer(make([]byte, 0, 2), size)
+	scanner.Split(ScanLongLines(bufio.ScanLines, size, mode))
+
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, longLinesCount, scanner.Err()
+}
+
+func TestScanLongLines(t *testing.T) {
+	input := "ab\nabcdefg\ncd\n"
+
+	t.Run("Should stop on long lines in fail mode", func(t *testing.T) {
+		lines, _, err := scanLongLines(input, 4, longLinesFail)
+		assert.ErrorIs(t, err, bufio.ErrTooLong)
+		assert.Equal(t, []string{"ab"}, lines)
+	})
+
+	t.Run("Should handle long lines", func(t *testing.T) {
+		cases := []struct {
+			mode     string
+			input    string
+			expected []string
+		}{
+			{longLinesSkip, input, []string{"ab", "cd"}},
+			{longLinesTruncate, input, []string{"ab", "abcd", "cd"}},
+			{longLinesSplit, input, []string{"ab", "abcd", "efg", "cd"}},
+			{longLinesSkip, "ab\nabcdefg", []string{"ab"}},
+			{longLinesTruncate, "ab\nabcdefg", []string{"ab", "abcd"}},
+			{longLinesSplit, "ab\nabcdefg", []string{"ab", "abcd", "efg"}},
+		}
+		for _, c := range cases {
+			lines, count, err := scanLongLines(c.input, 4, c.mode)
+			assert.NoError(t, err, c.mode)
+			assert.Equal(t, c.expected, lines, c.mode)
+			assert.Equal(t, 1, count, c.mode)
+		}
+	})
+
+	t.Run("Should not emit empty chunks for lines ending at a chunk boundary", func(t *testing.T) {
+		lines, count, err := scanLongLines("abcdefgh\n\nx\nabc", 4, longLinesSplit)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"abcd", "efgh", "", "x", "abc"}, lines)
+		assert.Equal(t, 1, count)
+	})
+}
@@ -0,0 +1,162 @@
+package patman
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxProbedLines bounds how many lines are read after an offset while
+// looking for one with a valid time, e.g. when landing in a stack trace
+const maxProbedLines = 1000
+
+// seekable reports whether the input can be narrowed to -since and -until
+// by binary searching offsets, rather than scanning it from the start.
+// It is opt-in with -sorted, as unsorted files would silently lose records.
+// Line numbers, printed as __line or in the -errors-file, are only known
+// when scanning from the start
+func seekable(f *os.File) bool {
+	if !sorted || delimiter != "" || (sinceTime.IsZero() && untilTime.IsZero()) {
+		return false
+	}
+	if slices.Contains(reservedFields, lineField) || errorsFile != nil {
+		return false
+	}
+
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
+
+// seekTimeRange binary searches a file sorted by -time-field, returning the
+// offsets of the first line at or after -since and of the first line after -until
+func seekTimeRange(f *os.File) (start, end int64, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+
+	// the time pipeline is compiled on its own, so
+	// probing lines does not affect other pipelines state
+	var probe *plan
+	for i, name := range compiled.names {
+		if name == timeField {
+			probe = compile([][]Command{pipelines[i]})
+		}
+	}
+
+	start, end = 0, size
+	if !sinceTime.IsZero() {
+		// lines before the first timed one in range either are before
+		// -since or follow a record before it, so the scan can start there
+		start, _, err = search(f, size, probe, false, func(t time.Time) bool {
+			return !t.Before(sinceTime)
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if !untilTime.IsZero() {
+		// untimed lines, like a stack trace, follow the record before them,
+		// so the scan ends at the first timed line after -until. Offsets
+		// without a timed line nearby are assumed to be in range
+		_, end, err = search(f, size, probe, true, func(t time.Time) bool {
+			return t.After(untilTime)
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return start, max(start, end), nil
+}
+
+// search binary searches the first line whose time satisfies found.
+// found must be monotonic over the file lines, as it is for sorted files.
+// Offsets not followed by a timed line within maxProbedLines are treated
+// as not found when inRange is true, e.g. when searching for an upper bound.
+// Returns the start of the line where the search ended and the offset of
+// the first timed line satisfying found at or after it, or size when none does
+func search(f *os.File, size int64, probe *plan, inRange bool, found func(t time.Time) bool) (line, timed int64, err error) {
+	lo, hi := int64(0), size
+	timed = size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		t, at, ok, err := timeAt(f, size, mid, probe)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if ok && found(t) {
+			hi, timed = mid, at
+		} else if !ok && !inRange {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	line, err = lineStart(f, size, lo)
+	return line, max(line, timed), err
+}
+
+// timeAt returns the time and offset of the first line starting at or after
+// offset with a valid time. ok is false when no such line is found.
+func timeAt(f *os.File, size, offset int64, probe *plan) (t time.Time, at int64, ok bool, err error) {
+	start, err := lineStart(f, size, offset)
+	if err != nil {
+		return time.Time{}, 0, false, err
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(f, start, size-start))
+	at = start
+	for i := 0; i < maxProbedLines; i++ {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			trimmed := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			results, _ := probe.eval(trimmed)
+			if t, ok := recordTime(results); ok {
+				return t, at, true, nil
+			}
+			at += int64(len(line))
+		}
+		if err == io.EOF {
+			return time.Time{}, 0, false, nil
+		}
+		if err != nil {
+			return time.Time{}, 0, false, err
+		}
+	}
+
+	return time.Time{}, 0, false, nil
+}
+
+// lineStart returns the offset of the first line starting at or after offset
+func lineStart(f *os.File, size, offset int64) (int64, error) {
+	if offset <= 0 {
+		return 0, nil
+	}
+	if offset >= size {
+		return size, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(f, offset-1, size-offset+1))
+	var skipped int64
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		skipped += int64(len(chunk))
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return offset - 1 + skipped, nil
+	}
+}
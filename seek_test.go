@@ -0,0 +1,127 @@
+package patman
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seekFile writes lines to a temporary file, with a pipeline
+// extracting their time as -time-field
+func seekFile(t *testing.T, lines []string) *os.File {
+	path := filepath.Join(t.TempDir(), "sorted.log")
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	prevPipelines, prevCompiled, prevField := pipelines, compiled, timeField
+	t.Cleanup(func() {
+		pipelines, compiled, timeField = prevPipelines, prevCompiled, prevField
+		sinceTime, untilTime = time.Time{}, time.Time{}
+	})
+
+	pipelines = [][]Command{mustParse(t, `m(^\d{4}-\S+) |> name(ts)`)}
+	compiled = compile(pipelines)
+	timeField = "ts"
+	return f
+}
+
+// seekedLines returns the lines within the offsets found by seekTimeRange
+func seekedLines(t *testing.T, f *os.File) []string {
+	start, end, err := seekTimeRange(f)
+	assert.NoError(t, err)
+
+	content := make([]byte, end-start)
+	_, err = f.ReadAt(content, start)
+	assert.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestSeek(t *testing.T) {
+	lines := []string{
+		"2024-01-01T00:00:00Z a",
+		"2024-01-02T00:00:00Z b",
+		"2024-01-03T00:00:00Z c",
+		"  at main.go:12",
+		"  at main.go:34",
+		"2024-01-05T00:00:00Z e",
+	}
+
+	t.Run("Should only seek files assumed to be sorted", func(t *testing.T) {
+		f := seekFile(t, lines)
+		sinceTime = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+		sorted = false
+		assert.False(t, seekable(f))
+
+		sorted = true
+		t.Cleanup(func() { sorted = false })
+		assert.True(t, seekable(f))
+	})
+
+	t.Run("Should seek to the first line at or after since", func(t *testing.T) {
+		f := seekFile(t, lines)
+		sinceTime = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+		assert.Equal(t, lines[1:], seekedLines(t, f))
+	})
+
+	t.Run("Should keep untimed lines following the last record in range", func(t *testing.T) {
+		f := seekFile(t, lines)
+		sinceTime = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+		untilTime = time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)
+
+		assert.Equal(t, lines[1:5], seekedLines(t, f))
+	})
+
+	t.Run("Should not end early on sparse timed lines", func(t *testing.T) {
+		sparse := []string{"2024-01-01T00:00:00Z a", "2024-01-02T00:00:00Z b"}
+		for i := 0; i < 3*maxProbedLines; i++ {
+			sparse = append(sparse, "  at main.go:12")
+		}
+		sparse = append(sparse, "2024-01-05T00:00:00Z e")
+
+		f := seekFile(t, sparse)
+		untilTime = time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)
+
+		assert.Equal(t, sparse[:len(sparse)-1], seekedLines(t, f))
+	})
+
+	t.Run("Should seek an empty range past the last record", func(t *testing.T) {
+		f := seekFile(t, lines)
+		sinceTime = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+		start, end, err := seekTimeRange(f)
+		assert.NoError(t, err)
+		assert.Equal(t, start, end)
+	})
+}
+
+func TestSeekLineNumbers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sorted.log")
+	content := "2024-01-01 a\n2024-01-02 b\n2024-01-03 c\n2024-01-04 d\n2024-01-05 e\n"
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	t.Run("Should not seek when printing line numbers", func(t *testing.T) {
+		out, status := runPatman(t, "", "-file", path, "-sorted", "-since", "2024-01-04",
+			"-time-field", "ts", "-format", "%__line %ts", "m(^\\S+) |> name(ts)")
+		assert.Equal(t, 0, status)
+		assert.Equal(t, "4 2024-01-04\n5 2024-01-05\n", out)
+	})
+
+	t.Run("Should not seek when writing errors with line numbers", func(t *testing.T) {
+		errorsPath := filepath.Join(t.TempDir(), "errors.json")
+		runPatman(t, "", "-file", path, "-sorted", "-since", "2024-01-05", "-time-field", "ts",
+			"-on-error", "skip", "-errors-file", errorsPath, "m(^\\S+) |> name(ts)", "m(e$) |> split(\\s/x)")
+
+		errors, err := os.ReadFile(errorsPath)
+		assert.NoError(t, err)
+		assert.Contains(t, string(errors), `"line_number":5`)
+	})
+}
@@ -0,0 +1,370 @@
+package patman
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"encoding/json"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// sortKey orders records by the match of a named pipeline
+type sortKey struct {
+	field   string
+	desc    bool
+	numeric bool
+}
+
+// sortKeys holds the keys of sort pipelines, in order of precedence
+var sortKeys []sortKey
+
+// setupSort extracts sort pipelines. They do not process lines,
+// they only define how output records are ordered
+func setupSort() {
+	var kept [][]Command
+	for _, cmds := range pipelines {
+		i := slices.IndexFunc(cmds, func(cmd Command) bool { return cmd.Name == "sort" })
+		if i < 0 {
+			kept = append(kept, cmds)
+			continue
+		}
+		if len(cmds) > 1 {
+			fatalf("sort must be a pipeline of its own, e.g. 'sort(latency/desc/numeric)'")
+		}
+
+		parts := strings.Split(cmds[i].Arg, "/")
+		key := sortKey{field: strings.TrimSpace(parts[0])}
+		if key.field == "" {
+			fatalf("sort requires the name of a pipeline to sort by")
+		}
+		for _, option := range parts[1:] {
+			switch strings.TrimSpace(option) {
+			case "asc":
+			case "desc":
+				key.desc = true
+			case "numeric":
+				key.numeric = true
+			default:
+				fatalf("unknown sort option `%s`, expected asc, desc or numeric", option)
+			}
+		}
+		sortKeys = append(sortKeys, key)
+	}
+	pipelines = kept
+}
+
+// validateSortKeys fails on sort keys not matching any output field,
+// which would silently keep records in input order
+func validateSortKeys() {
+	for _, key := range sortKeys {
+		if !isOutputField(key.field) {
+			fatalf("sort key `%s` must have a matching named pipeline or output field", key.field)
+		}
+	}
+}
+
+// isOutputField reports whether records can have a field named name,
+// e.g. a named pipeline, a reserved field or an aggregate output like `latency.p99`
+func isOutputField(name string) bool {
+	if slices.Contains(pipelineNames, name) || slices.Contains(reservedFields, name) {
+		return true
+	}
+	if (name == "window" && windowSize > 0) || (name == "count" && uniqCount) {
+		return true
+	}
+	for _, p := range aggregatePipelines {
+		if strings.HasPrefix(name, p.name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func sorting() bool {
+	return len(sortKeys) > 0
+}
+
+type sortedRecord struct {
+	Seq    int64      `json:"seq"`
+	Record [][]string `json:"record"`
+
+	// keys holds the value of each sort key
+	keys []string
+}
+
+func newSortedRecord(seq int64, record [][]string) sortedRecord {
+	r := sortedRecord{Seq: seq, Record: record, keys: make([]string, len(sortKeys))}
+	for i, key := range sortKeys {
+		for _, field := range record {
+			if field[1] == key.field {
+				r.keys[i] = field[0]
+				break
+			}
+		}
+	}
+	return r
+}
+
+// compareRecords orders records by sort keys, then by appearance.
+// Records missing a key, or with non numeric keys when sorting
+// numerically, are printed last
+func compareRecords(a, b sortedRecord) int {
+	for i, key := range sortKeys {
+		if c := compareKeys(a.keys[i], b.keys[i], key); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.Seq, b.Seq)
+}
+
+func compareKeys(a, b string, key sortKey) int {
+	if key.numeric {
+		x, xok := parseNumber(a)
+		y, yok := parseNumber(b)
+		switch {
+		case !xok || !yok:
+			return cmp.Compare(boolRank(xok), boolRank(yok))
+		case key.desc:
+			return cmp.Compare(y, x)
+		default:
+			return cmp.Compare(x, y)
+		}
+	}
+
+	switch {
+	case a == "" || b == "":
+		return cmp.Compare(boolRank(a != ""), boolRank(b != ""))
+	case key.desc:
+		return strings.Compare(b, a)
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+// boolRank ranks true ahead of false
+func boolRank(ok bool) int {
+	if ok {
+		return 0
+	}
+	return 1
+}
+
+// sortFanIn is the number of runs merged at once. Runs are merged as soon
+// as sortFanIn runs of the same level are spilled, so open runs grow with
+// the log of input size, e.g. at most 45 runs for 40GB at -mem 10
+var sortFanIn = 16
+
+// sorter buffers records in memory up to budget bytes. Beyond that,
+// buffered records are sorted and spilled to a temporary file as a run.
+// Once input ends runs are merged, so memory stays bounded by
+// budget plus a record per run
+type sorter struct {
+	budget int
+	size   int
+	seq    int64
+
+	records []sortedRecord
+	runs    []spilledRun
+}
+
+// spilledRun is a run spilled to a file. Runs of level n
+// are the merge of sortFanIn runs of level n-1
+type spilledRun struct {
+	file  *os.File
+	level int
+}
+
+func newSorter(budget int) *sorter {
+	return &sorter{budget: budget}
+}
+
+// printer returns a printer feeding records to the sorter
+func (s *sorter) printer() printer {
+	return func(record [][]string) {
+		s.add(record)
+	}
+}
+
+func (s *sorter) add(record [][]string) {
+	s.records = append(s.records, newSortedRecord(s.seq, record))
+	s.seq++
+
+	for _, field := range record {
+		s.size += len(field[0]) + len(field[1]) + 48
+	}
+	if s.size > s.budget {
+		s.spill()
+	}
+}
+
+// spill writes the buffered records, sorted, to a temporary file
+func (s *sorter) spill() {
+	slices.SortFunc(s.records, compareRecords)
+	s.writeRun(0, func(write func(sortedRecord)) {
+		for _, r := range s.records {
+			write(r)
+		}
+	})
+	s.records = s.records[:0]
+	s.size = 0
+
+	// like carries in a counter, merging runs
+	// may complete a level above them
+	for {
+		last := s.runs[len(s.runs)-1].level
+		n := 0
+		for n < len(s.runs) && s.runs[len(s.runs)-1-n].level == last {
+			n++
+		}
+		if n < sortFanIn {
+			return
+		}
+		s.mergeRuns(n, last+1)
+	}
+}
+
+// writeRun appends a run of level to runs, with the records written by fill
+func (s *sorter) writeRun(level int, fill func(write func(sortedRecord))) {
+	f, err := os.CreateTemp("", "patman-sort-*")
+	if err != nil {
+		fatalf("failed to create sort run: %v", err)
+	}
+	// runs are removed while still open, so they never outlive
+	// patman, even when killed or exiting early. Where open files
+	// cannot be removed, e.g. on Windows, close removes them
+	os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	fill(func(r sortedRecord) {
+		if err := encoder.Encode(r); err != nil {
+			fatalf("failed to write sort run: %v", err)
+		}
+	})
+	if err := w.Flush(); err != nil {
+		fatalf("failed to write sort run: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		fatalf("failed to read sort run: %v", err)
+	}
+
+	s.runs = append(s.runs, spilledRun{file: f, level: level})
+}
+
+// mergeRuns merges the last n runs into a single run of level
+func (s *sorter) mergeRuns(n, level int) {
+	merged := slices.Clone(s.runs[len(s.runs)-n:])
+	s.runs = s.runs[:len(s.runs)-n]
+
+	s.writeRun(level, func(write func(sortedRecord)) {
+		merge(merged, nil, write)
+	})
+	for _, r := range merged {
+		r.file.Close()
+		os.Remove(r.file.Name())
+	}
+}
+
+// flush prints all records in order, merging spilled runs
+// with the records still in memory
+func (s *sorter) flush(print printer) {
+	slices.SortFunc(s.records, compareRecords)
+	defer s.close()
+
+	// runs of different levels can still be more than the fan-in
+	for len(s.runs) > sortFanIn {
+		s.mergeRuns(sortFanIn, s.runs[len(s.runs)-sortFanIn].level+1)
+	}
+
+	merge(s.runs, s.records, func(r sortedRecord) {
+		print(r.Record)
+	})
+}
+
+// merge writes the records of runs and of the sorted records in order
+func merge(runs []spilledRun, records []sortedRecord, write func(sortedRecord)) {
+	h := &runHeap{}
+	for _, r := range runs {
+		run := &run{reader: bufio.NewReader(r.file)}
+		if run.next() {
+			heap.Push(h, run)
+		}
+	}
+	if len(records) > 0 {
+		run := &run{records: records}
+		if run.next() {
+			heap.Push(h, run)
+		}
+	}
+
+	for h.Len() > 0 {
+		run := (*h)[0]
+		write(run.current)
+		if run.next() {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+}
+
+func (s *sorter) close() {
+	for _, r := range s.runs {
+		r.file.Close()
+		os.Remove(r.file.Name())
+	}
+	s.runs = nil
+}
+
+// run is a sorted sequence of records, read
+// either from a spilled file or from memory
+type run struct {
+	reader  *bufio.Reader
+	records []sortedRecord
+	current sortedRecord
+}
+
+func (r *run) next() bool {
+	if r.reader == nil {
+		if len(r.records) == 0 {
+			return false
+		}
+		r.current, r.records = r.records[0], r.records[1:]
+		return true
+	}
+
+	line, err := r.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return false
+	}
+	if err != nil && err != io.EOF {
+		fatalf("failed to read sort run: %v", err)
+	}
+
+	var record sortedRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		fatalf("failed to read sort run: %v", err)
+	}
+	r.current = newSortedRecord(record.Seq, record.Record)
+	return true
+}
+
+type runHeap []*run
+
+func (h runHeap) Len() int { return len(h) }
+
+func (h runHeap) Less(i, j int) bool { return compareRecords(h[i].current, h[j].current) < 0 }
+
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *runHeap) Push(x any) { *h = append(*h, x.(*run)) }
+
+func (h *runHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
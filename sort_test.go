@@ -0,0 +1,105 @@
+package patman
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSorter(t *testing.T) {
+	sortKeys = []sortKey{{field: "n", desc: true, numeric: true}}
+	defer func() { sortKeys = nil }()
+
+	records := [][][]string{
+		{{"3", "n"}, {"a", "x"}},
+		{{"x", "n"}, {"b", "x"}},
+		{{"10", "n"}, {"c", "x"}},
+		{{"3", "n"}, {"d", "x"}},
+		{{"1", "n"}, {"e", "x"}},
+	}
+	expected := []string{"c", "a", "d", "e", "b"}
+
+	for _, budget := range []int{1 << 20, 1} {
+		t.Run("Should sort with budget "+strconv.Itoa(budget), func(t *testing.T) {
+			s := newSorter(budget)
+			for _, record := range records {
+				s.add(record)
+			}
+
+			var printed []string
+			s.flush(func(record [][]string) {
+				printed = append(printed, record[1][0])
+			})
+			assert.Equal(t, expected, printed)
+		})
+	}
+}
+
+func TestSortRuns(t *testing.T) {
+	sortKeys = []sortKey{{field: "n"}}
+	defer func() { sortKeys = nil }()
+
+	t.Run("Should not leave runs behind while sorting", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("TMPDIR", dir)
+
+		s := newSorter(1)
+		s.add([][]string{{"b", "n"}})
+		s.add([][]string{{"a", "n"}})
+		assert.Len(t, s.runs, 2)
+
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+
+		var printed []string
+		s.flush(func(record [][]string) {
+			printed = append(printed, record[0][0])
+		})
+		assert.Equal(t, []string{"a", "b"}, printed)
+	})
+}
+
+func TestSortMerge(t *testing.T) {
+	sortKeys = []sortKey{{field: "n", numeric: true}}
+	prevFanIn := sortFanIn
+	defer func() { sortKeys, sortFanIn = nil, prevFanIn }()
+	sortFanIn = 3
+
+	t.Run("Should merge runs in stages beyond the fan-in", func(t *testing.T) {
+		s := newSorter(1)
+		maxRuns := 0
+		for i := 0; i < 100; i++ {
+			s.add([][]string{{strconv.Itoa((i * 37) % 100), "n"}})
+			maxRuns = max(maxRuns, len(s.runs))
+		}
+		// at most sortFanIn-1 runs for each of the 5 levels of 100 runs
+		assert.LessOrEqual(t, maxRuns, 10)
+
+		var printed []string
+		s.flush(func(record [][]string) {
+			printed = append(printed, record[0][0])
+		})
+		assert.Len(t, printed, 100)
+		for i, n := range printed {
+			assert.Equal(t, strconv.Itoa(i), n)
+		}
+	})
+}
+
+func TestSortKeys(t *testing.T) {
+	prevNames, prevAggregates := pipelineNames, aggregatePipelines
+	defer func() { pipelineNames, aggregatePipelines = prevNames, prevAggregates }()
+
+	pipelineNames = []string{"ip", "latency"}
+	aggregatePipelines = []aggregatePipeline{{name: "latency"}}
+
+	t.Run("Should only sort by output fields", func(t *testing.T) {
+		assert.True(t, isOutputField("ip"))
+		assert.True(t, isOutputField("latency.p99"))
+		assert.False(t, isOutputField("typo"))
+		assert.False(t, isOutputField("count"))
+	})
+}
@@ -0,0 +1,147 @@
+package patman
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+)
+
+type counter struct {
+	key   string
+	count int64
+
+	// err bounds the overestimation of count, inherited
+	// from the counter evicted when key was inserted
+	err int64
+
+	// position in the heap
+	index int
+}
+
+// spaceSaving is a sketch finding the most frequent keys of a stream with
+// a fixed number of counters (Metwally et al., "Efficient Computation of
+// Frequent and Top-k Elements in Data Streams"). When full, a new key
+// replaces the least frequent counter, inheriting its count as error.
+type spaceSaving struct {
+	capacity int
+	counters map[string]*counter
+
+	// min heap of counters by count
+	heap counterHeap
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*counter, capacity),
+	}
+}
+
+func (s *spaceSaving) add(key string) {
+	s.addCount(key, 1, 0)
+}
+
+func (s *spaceSaving) addCount(key string, count, err int64) {
+	if c, ok := s.counters[key]; ok {
+		c.count += count
+		c.err += err
+		heap.Fix(&s.heap, c.index)
+		return
+	}
+
+	if len(s.heap) < s.capacity {
+		c := &counter{key: key, count: count, err: err}
+		s.counters[key] = c
+		heap.Push(&s.heap, c)
+		return
+	}
+
+	// replace the least frequent key, which may have occurred
+	// up to its count times before being evicted
+	c := s.heap[0]
+	delete(s.counters, c.key)
+	c.key = key
+	c.err = c.count + err
+	c.count += count
+	s.counters[key] = c
+	heap.Fix(&s.heap, 0)
+}
+
+// minCount is the count of the least frequent key, bounding
+// the count of keys not tracked. It is 0 until the sketch is full
+func (s *spaceSaving) minCount() int64 {
+	if len(s.heap) < s.capacity {
+		return 0
+	}
+	return s.heap[0].count
+}
+
+// merge adds the counters of other. Keys missing from either sketch
+// may have occurred up to its minimum count times, which is
+// added to both their count and error
+func (s *spaceSaving) merge(other *spaceSaving) {
+	selfMin, otherMin := s.minCount(), other.minCount()
+
+	if selfMin > 0 {
+		for _, c := range other.heap {
+			if _, ok := s.counters[c.key]; !ok {
+				c.count += selfMin
+				c.err += selfMin
+			}
+		}
+	}
+	if otherMin > 0 {
+		for _, c := range s.heap {
+			if _, ok := other.counters[c.key]; !ok {
+				c.count += otherMin
+				c.err += otherMin
+			}
+		}
+		heap.Init(&s.heap)
+	}
+
+	for _, c := range other.heap {
+		s.addCount(c.key, c.count, c.err)
+	}
+}
+
+// top returns up to k counters, most frequent first
+func (s *spaceSaving) top(k int) []counter {
+	counters := make([]counter, 0, len(s.heap))
+	for _, c := range s.heap {
+		counters = append(counters, *c)
+	}
+	slices.SortFunc(counters, func(a, b counter) int {
+		if c := cmp.Compare(b.count, a.count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.key, b.key)
+	})
+
+	return counters[:min(k, len(counters))]
+}
+
+type counterHeap []*counter
+
+func (h counterHeap) Len() int { return len(h) }
+
+func (h counterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x any) {
+	c := x.(*counter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
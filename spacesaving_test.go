@@ -0,0 +1,61 @@
+package patman
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	t.Run("Should count keys exactly below capacity", func(t *testing.T) {
+		s := newSpaceSaving(10)
+		for _, key := range []string{"a", "b", "a", "c", "a", "b"} {
+			s.add(key)
+		}
+
+		top := s.top(2)
+		assert.Len(t, top, 2)
+		assert.Equal(t, "a", top[0].key)
+		assert.Equal(t, int64(3), top[0].count)
+		assert.Equal(t, "b", top[1].key)
+		assert.Equal(t, int64(2), top[1].count)
+		assert.Equal(t, int64(0), top[1].err)
+	})
+
+	t.Run("Should find heavy hitters of a long tail", func(t *testing.T) {
+		s := newSpaceSaving(100)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 100000; i++ {
+			if i%10 < 3 {
+				s.add("heavy" + strconv.Itoa(i%3))
+				continue
+			}
+			s.add(strconv.Itoa(r.Intn(50000)))
+		}
+
+		top := s.top(3)
+		for _, c := range top {
+			assert.Contains(t, []string{"heavy0", "heavy1", "heavy2"}, c.key)
+			assert.LessOrEqual(t, c.count-c.err, int64(10000))
+			assert.GreaterOrEqual(t, c.count, int64(10000))
+		}
+	})
+
+	t.Run("Should merge sketches", func(t *testing.T) {
+		a, b := newSpaceSaving(10), newSpaceSaving(10)
+		for i := 0; i < 100; i++ {
+			a.add("x")
+			b.add("x")
+			b.add("y")
+		}
+		a.merge(b)
+
+		top := a.top(2)
+		assert.Equal(t, "x", top[0].key)
+		assert.Equal(t, int64(200), top[0].count)
+		assert.Equal(t, "y", top[1].key)
+		assert.Equal(t, int64(100), top[1].count)
+	})
+}
@@ -0,0 +1,146 @@
+package patman
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// handleTrim removes leading and trailing whitespace, or
+// the characters of the provided cutset. e.g. `trim(_)`, `trim("')`
+func handleTrim(line, arg string) (string, error) {
+	if arg == "_" {
+		return strings.TrimSpace(line), nil
+	}
+	return strings.Trim(line, arg), nil
+}
+
+func handleTrimPrefix(line, arg string) (string, error) {
+	return strings.TrimPrefix(line, arg), nil
+}
+
+func handleTrimSuffix(line, arg string) (string, error) {
+	return strings.TrimSuffix(line, arg), nil
+}
+
+// handleSubstr returns the characters from start, up to an optional length.
+// A negative start counts from the end of the line. e.g. `substr(0/3)`, `substr(-4)`
+func handleSubstr(line, arg string) (string, error) {
+	startArg, lengthArg, hasLength := strings.Cut(arg, "/")
+	start, err := strconv.Atoi(strings.TrimSpace(startArg))
+	if err != nil {
+		return "", fmt.Errorf("`%s` is not a valid start for substr operator", startArg)
+	}
+
+	runes := []rune(line)
+	if start < 0 {
+		start = max(0, len(runes)+start)
+	}
+	start = min(start, len(runes))
+
+	end := len(runes)
+	if hasLength {
+		length, err := strconv.Atoi(strings.TrimSpace(lengthArg))
+		if err != nil || length < 0 {
+			return "", fmt.Errorf("`%s` is not a valid length for substr operator", lengthArg)
+		}
+		end = min(end, start+length)
+	}
+
+	return string(runes[start:end]), nil
+}
+
+// handlePad pads a line to width characters. Arguments are / separated:
+// width, padding character (default space) and side, left or right (default).
+// e.g. `pad(10)`, `pad(8/0/left)`
+func handlePad(line, arg string) (string, error) {
+	if line == "" {
+		return "", nil
+	}
+
+	parts := strings.Split(arg, "/")
+	width, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || width < 0 {
+		return "", fmt.Errorf("`%s` is not a valid width for pad operator", parts[0])
+	}
+
+	char := " "
+	if len(parts) > 1 && parts[1] != "" {
+		if utf8.RuneCountInString(parts[1]) != 1 {
+			return "", fmt.Errorf("`%s` is not a single character for pad operator", parts[1])
+		}
+		char = parts[1]
+	}
+
+	missing := width - utf8.RuneCountInString(line)
+	if missing <= 0 {
+		return line, nil
+	}
+
+	side := "right"
+	if len(parts) > 2 {
+		side = strings.TrimSpace(parts[2])
+	}
+	switch side {
+	case "left":
+		return strings.Repeat(char, missing) + line, nil
+	case "right":
+		return line + strings.Repeat(char, missing), nil
+	}
+	return "", fmt.Errorf("`%s` is not a valid side for pad operator, expected left or right", side)
+}
+
+// handleLen returns the number of characters of a line
+func handleLen(line, arg string) (string, error) {
+	if line == "" {
+		return "", nil
+	}
+	return strconv.Itoa(utf8.RuneCountInString(line)), nil
+}
+
+func handleReverse(line, arg string) (string, error) {
+	runes := []rune(line)
+	slices.Reverse(runes)
+	return string(runes), nil
+}
+
+func handleRepeat(line, arg string) (string, error) {
+	count, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || count < 0 {
+		return "", fmt.Errorf("`%s` is not a valid count for repeat operator", arg)
+	}
+	return strings.Repeat(line, count), nil
+}
+
+func handleTitle(line, arg string) (string, error) {
+	return cases.Title(language.Und).String(line), nil
+}
+
+// handleCaseFold folds case for caseless comparisons, e.g.
+// `Straße` and `STRASSE` both fold to `strasse`
+func handleCaseFold(line, arg string) (string, error) {
+	return cases.Fold().String(line), nil
+}
+
+var normalForms = map[string]norm.Form{
+	"nfc":  norm.NFC,
+	"nfd":  norm.NFD,
+	"nfkc": norm.NFKC,
+	"nfkd": norm.NFKD,
+}
+
+// handleNormalize applies a unicode normalization form, so that
+// equivalent strings, e.g. composed and decomposed accents, compare equal
+func handleNormalize(line, arg string) (string, error) {
+	form, ok := normalForms[strings.ToLower(strings.TrimSpace(arg))]
+	if !ok {
+		return "", fmt.Errorf("`%s` is not a valid normalization form, expected nfc, nfd, nfkc or nfkd", arg)
+	}
+	return form.String(line), nil
+}
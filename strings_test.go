@@ -0,0 +1,50 @@
+package patman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStringOperators(t *testing.T) {
+	t.Run("Should apply string operators", func(t *testing.T) {
+		cases := []struct {
+			op       operator
+			line     string
+			arg      string
+			expected string
+		}{
+			{handleTrim, "  hello  ", "_", "hello"},
+			{handleTrim, `"quoted"`, `"`, "quoted"},
+			{handleTrimPrefix, "user=alice", "user=", "alice"},
+			{handleSubstr, "héllo world", "1/4", "éllo"},
+			{handleSubstr, "hello world", "-5", "world"},
+			{handleSubstr, "hello", "10/2", ""},
+			{handlePad, "42", "6/0/left", "000042"},
+			{handlePad, "42", "4", "42  "},
+			{handleLen, "héllo", "_", "5"},
+			{handleLen, "", "_", ""},
+			{handlePad, "", "5/x", ""},
+			{handleReverse, "héllo", "_", "olléh"},
+			{handleRepeat, "ab", "3", "ababab"},
+			{handleTitle, "hello world", "_", "Hello World"},
+			{handleCaseFold, "Straße", "_", "strasse"},
+			{handleNormalize, "ｈｅｌｌｏ ﬁ", "nfkc", "hello fi"},
+			{handleNormalize, "é", "nfc", "é"},
+		}
+		for _, c := range cases {
+			out, err := c.op(c.line, c.arg)
+			assert.NoError(t, err, c.line)
+			assert.Equal(t, c.expected, out, c.line)
+		}
+	})
+
+	t.Run("Should error on invalid arguments", func(t *testing.T) {
+		_, err := handleNormalize("a", "nfx")
+		assert.Error(t, err)
+		_, err = handlePad("a", "4/ab")
+		assert.Error(t, err)
+		_, err = handleRepeat("a", "-1")
+		assert.Error(t, err)
+	})
+}
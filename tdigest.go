@@ -0,0 +1,142 @@
+package patman
+
+import (
+	"math"
+	"slices"
+)
+
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+// tdigest is a bounded-memory sketch estimating quantiles of a stream
+// (Dunning, "Computing extremely accurate quantiles using t-digests").
+// Values are summarized by at most ~compression centroids, smaller
+// towards the tails, so that extreme quantiles stay accurate.
+type tdigest struct {
+	compression float64
+	centroids   []centroid
+
+	// pending values, merged into centroids once full
+	buffer []centroid
+
+	count    float64
+	min, max float64
+}
+
+func newTdigest(compression float64) *tdigest {
+	return &tdigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+func (t *tdigest) add(value float64) {
+	t.buffer = append(t.buffer, centroid{mean: value, count: 1})
+	t.count++
+	t.min = math.Min(t.min, value)
+	t.max = math.Max(t.max, value)
+
+	if len(t.buffer) >= int(5*t.compression) {
+		t.compress()
+	}
+}
+
+// k is the scale function bounding the size of centroids
+// depending on the quantile they cover
+func (t *tdigest) k(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (t *tdigest) kInverse(k float64) float64 {
+	return (math.Sin(k*2*math.Pi/t.compression) + 1) / 2
+}
+
+// compress merges pending values into the centroids
+func (t *tdigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+
+	all := append(t.centroids, t.buffer...)
+	t.buffer = t.buffer[:0]
+	slices.SortFunc(all, func(a, b centroid) int {
+		switch {
+		case a.mean < b.mean:
+			return -1
+		case a.mean > b.mean:
+			return 1
+		}
+		return 0
+	})
+
+	merged := []centroid{all[0]}
+	qLeft := 0.0
+	qLimit := t.kInverse(t.k(qLeft) + 1)
+	for _, c := range all[1:] {
+		current := &merged[len(merged)-1]
+		q := qLeft + (current.count+c.count)/t.count
+		if q <= qLimit {
+			current.mean += (c.mean - current.mean) * c.count / (current.count + c.count)
+			current.count += c.count
+			continue
+		}
+
+		qLeft += current.count / t.count
+		qLimit = t.kInverse(t.k(qLeft) + 1)
+		merged = append(merged, c)
+	}
+
+	t.centroids = merged
+}
+
+// quantile estimates the value below which falls
+// a fraction q of the values added so far
+func (t *tdigest) quantile(q float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 {
+		return math.NaN()
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].mean
+	}
+
+	target := q * t.count
+	var cumulative float64
+	for i, c := range t.centroids {
+		center := cumulative + c.count/2
+		if target < center {
+			if i == 0 {
+				return interpolate(t.min, c.mean, target/center)
+			}
+			prev := t.centroids[i-1]
+			prevCenter := cumulative - prev.count/2
+			return interpolate(prev.mean, c.mean, (target-prevCenter)/(center-prevCenter))
+		}
+		cumulative += c.count
+	}
+
+	last := t.centroids[len(t.centroids)-1]
+	lastCenter := t.count - last.count/2
+	return interpolate(last.mean, t.max, (target-lastCenter)/(t.count-lastCenter))
+}
+
+func interpolate(from, to, ratio float64) float64 {
+	return from + (to-from)*ratio
+}
+
+// merge adds the centroids of other, as if its values were added to t
+func (t *tdigest) merge(other *tdigest) {
+	if other.count == 0 {
+		return
+	}
+
+	t.buffer = append(t.buffer, other.centroids...)
+	t.buffer = append(t.buffer, other.buffer...)
+	t.count += other.count
+	t.min = math.Min(t.min, other.min)
+	t.max = math.Max(t.max, other.max)
+	t.compress()
+}
@@ -0,0 +1,48 @@
+package patman
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTdigest(t *testing.T) {
+	t.Run("Should estimate quantiles of a uniform distribution", func(t *testing.T) {
+		td := newTdigest(100)
+		r := rand.New(rand.NewSource(1))
+		for _, i := range r.Perm(100000) {
+			td.add(float64(i + 1))
+		}
+
+		assert.InEpsilon(t, 50000, td.quantile(0.5), 0.01)
+		assert.InEpsilon(t, 95000, td.quantile(0.95), 0.01)
+		assert.InEpsilon(t, 99000, td.quantile(0.99), 0.005)
+		assert.InEpsilon(t, 99900, td.quantile(0.999), 0.001)
+		assert.LessOrEqual(t, len(td.centroids), 200)
+	})
+
+	t.Run("Should estimate tails of a skewed distribution", func(t *testing.T) {
+		td := newTdigest(100)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 50000; i++ {
+			td.add(r.ExpFloat64() * 100)
+		}
+
+		// exact p99 of an exponential distribution with mean 100
+		assert.InEpsilon(t, -100*math.Log(0.01), td.quantile(0.99), 0.05)
+	})
+
+	t.Run("Should handle few values", func(t *testing.T) {
+		td := newTdigest(100)
+		assert.True(t, math.IsNaN(td.quantile(0.5)))
+
+		td.add(42)
+		assert.Equal(t, 42.0, td.quantile(0.5))
+
+		td.add(42)
+		td.add(42)
+		assert.Equal(t, 42.0, td.quantile(0.99))
+	})
+}
@@ -0,0 +1,223 @@
+package patman
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeLayouts are the layouts tried, in order, when auto detecting timestamps
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"02/Jan/2006:15:04:05 -0700", // apache
+	time.RFC1123Z,
+	time.RFC1123,
+	time.Stamp, // syslog
+	time.DateOnly,
+}
+
+// namedLayouts can be used in place of Go layouts by the time operator
+var namedLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123Z,
+	"datetime":    time.DateTime,
+	"date":        time.DateOnly,
+	"syslog":      time.Stamp,
+	"apache":      "02/Jan/2006:15:04:05 -0700",
+	"kitchen":     time.Kitchen,
+}
+
+// epoch layouts are handled separately, as Go layouts cannot express them
+var epochLayouts = map[string]func(t time.Time) string{
+	"unix":   func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	"unixms": func(t time.Time) string { return strconv.FormatInt(t.UnixMilli(), 10) },
+	"unixus": func(t time.Time) string { return strconv.FormatInt(t.UnixMicro(), 10) },
+	"unixns": func(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) },
+}
+
+// parseTime parses a timestamp in any of the known layouts, or
+// an epoch in seconds, milliseconds, microseconds or nanoseconds
+// depending on its number of digits.
+// e.g. `2024-01-02T15:04:05Z`, `1704207845123`, `Jan  2 15:04:05`
+func parseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		switch digits := len(strings.TrimPrefix(value, "-")); {
+		case digits <= 10:
+			return time.Unix(epoch, 0), nil
+		case digits <= 13:
+			return time.UnixMilli(epoch), nil
+		case digits <= 16:
+			return time.UnixMicro(epoch), nil
+		default:
+			return time.Unix(0, epoch), nil
+		}
+	}
+
+	for _, layout := range timeLayouts {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		// layouts without year, like syslog, are parsed as year 0
+		if t.Year() == 0 {
+			t = t.AddDate(time.Now().Year(), 0, 0)
+		}
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("`%s` is not a known timestamp format", value)
+}
+
+// parseTimeLayout parses value using layout, which can be
+// a Go layout, a named layout, an epoch layout or auto
+func parseTimeLayout(value, layout string) (time.Time, error) {
+	if layout == "auto" {
+		return parseTime(value)
+	}
+	if _, ok := epochLayouts[layout]; ok {
+		return parseTime(value)
+	}
+	if named, ok := namedLayouts[layout]; ok {
+		layout = named
+	}
+	return time.Parse(layout, strings.TrimSpace(value))
+}
+
+// formatTimeLayout formats t using layout, which can be
+// a Go layout, a named layout or an epoch layout
+func formatTimeLayout(t time.Time, layout string) string {
+	if format, ok := epochLayouts[layout]; ok {
+		return format(t)
+	}
+	if named, ok := namedLayouts[layout]; ok {
+		layout = named
+	}
+	return t.Format(layout)
+}
+
+var locationCache = sync.Map{} // map[string]*time.Location
+
+func location(name string) (*time.Location, error) {
+	if cached, ok := locationCache.Load(name); ok {
+		return cached.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("`%s` is not a valid timezone", name)
+	}
+
+	locationCache.Store(name, loc)
+	return loc, nil
+}
+
+// parseDuration extends time.ParseDuration with days and weeks
+// e.g. `15m`, `2d`, `1w`
+func parseDuration(value string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			days, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, fmt.Errorf("`%s` is not a valid duration", value)
+			}
+			return time.Duration(days * float64(unit)), nil
+		}
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("`%s` is not a valid duration", value)
+	}
+	return d, nil
+}
+
+var boundCache = sync.Map{} // map[string]time.Time
+
+// parseBound parses an absolute time, `now` or a time relative to now.
+// Relative times are resolved once, so they stay fixed during a run
+// e.g. `2024-01-02T15:04:05Z`, `2024-01-02`, `15m ago`, `now`
+func parseBound(value string) (time.Time, error) {
+	if cached, ok := boundCache.Load(value); ok {
+		return cached.(time.Time), nil
+	}
+
+	var bound time.Time
+	var err error
+
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "now" {
+		bound = time.Now()
+	} else if ago, ok := strings.CutSuffix(trimmed, " ago"); ok {
+		var d time.Duration
+		d, err = parseDuration(strings.TrimSpace(ago))
+		bound = time.Now().Add(-d)
+	} else {
+		bound, err = parseTime(trimmed)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	boundCache.Store(value, bound)
+	return bound, nil
+}
+
+var sinceTime time.Time
+var untilTime time.Time
+
+// setupTimeRange parses the -since and -until flags
+func setupTimeRange() error {
+	if since == "" && until == "" {
+		return nil
+	}
+	if !slices.Contains(pipelineNames, timeField) {
+		return fmt.Errorf("-since and -until require a -time-field with a matching named pipeline")
+	}
+
+	var err error
+	if since != "" {
+		if sinceTime, err = parseBound(since); err != nil {
+			return err
+		}
+	}
+	if until != "" {
+		if untilTime, err = parseBound(until); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastInTimeRange is the outcome of inTimeRange for the last timed record
+var lastInTimeRange bool
+
+// inTimeRange reports whether the -time-field of a record is within
+// -since and -until. Records without a valid time, like stack traces,
+// follow the preceding record
+func inTimeRange(results [][]string) bool {
+	if sinceTime.IsZero() && untilTime.IsZero() {
+		return true
+	}
+
+	t, ok := recordTime(results)
+	if !ok {
+		return lastInTimeRange
+	}
+
+	lastInTimeRange = (sinceTime.IsZero() || !t.Before(sinceTime)) &&
+		(untilTime.IsZero() || !t.After(untilTime))
+	return lastInTimeRange
+}
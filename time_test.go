@@ -0,0 +1,56 @@
+package patman
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTime(t *testing.T) {
+	expected := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	t.Run("Should detect known layouts", func(t *testing.T) {
+		values := []string{
+			"2024-01-02T15:04:05Z",
+			"2024-01-02T16:04:05+01:00",
+			"2024-01-02 15:04:05",
+			"02/Jan/2024:15:04:05 +0000",
+			"Tue, 02 Jan 2024 15:04:05 +0000",
+			"1704207845",
+			"1704207845000",
+			"1704207845000000",
+			"1704207845000000000",
+		}
+		for _, value := range values {
+			parsed, err := parseTime(value)
+			assert.NoError(t, err, value)
+			assert.True(t, expected.Equal(parsed), value)
+		}
+	})
+
+	t.Run("Should assume current year for syslog timestamps", func(t *testing.T) {
+		parsed, err := parseTime("Jan  2 15:04:05")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Now().Year(), parsed.Year())
+		assert.Equal(t, 15, parsed.Hour())
+	})
+
+	t.Run("Should error on unknown layouts", func(t *testing.T) {
+		_, err := parseTime("yesterday at noon")
+		assert.Error(t, err)
+	})
+
+	t.Run("Should parse relative bounds", func(t *testing.T) {
+		bound, err := parseBound("2d ago")
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(-48*time.Hour), bound, time.Minute)
+
+		bound, err = parseBound("15m ago")
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(-15*time.Minute), bound, time.Minute)
+
+		_, err = parseBound("15 parsecs ago")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,252 @@
+package patman
+
+import (
+	"container/list"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	uniqLRU   = "lru"
+	uniqBloom = "bloom"
+)
+
+// bloomFalsePositiveRate is the rate of distinct lines wrongly
+// dropped by uniq(bloom/N), as long as at most N distinct lines are seen
+const bloomFalsePositiveRate = 0.01
+
+// seenSet records the lines seen by a uniq stage
+type seenSet interface {
+	// seen records line, reporting whether it was already recorded
+	seen(line string) bool
+}
+
+// newUniq returns a uniq operator with its own set of seen lines.
+// Every pipeline gets its own instance, so that the same line
+// can be printed once by each of them.
+//   - `_` remembers every distinct line
+//   - `lru/N` remembers the N most recently seen distinct lines
+//   - `bloom/N` remembers lines in a Bloom filter sized for N distinct
+//     lines, dropping ~1% of distinct lines as false positives
+func newUniq(arg string) operator {
+	if uniqCount {
+		return newUniqCounter(func(line string) string { return line })
+	}
+
+	var set seenSet
+	switch mode, size, _ := strings.Cut(arg, "/"); mode {
+	case uniqLRU:
+		set = newLRUSet(parseUniqSize(size))
+	case uniqBloom:
+		set = newBloomFilter(parseUniqSize(size), bloomFalsePositiveRate)
+	default:
+		set = &exactSet{lines: map[string]struct{}{}}
+	}
+
+	var mu sync.Mutex
+	return func(line, arg string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if set.seen(line) {
+			return "", nil
+		}
+		return line, nil
+	}
+}
+
+// newUniqBy returns an operator removing lines whose key, the first
+// match of the regex arg, was already seen. Lines are passed through
+// unmodified, so that e.g. lines differing only in timestamp collapse.
+// Lines without a key are never removed
+func newUniqBy(arg string) operator {
+	re := regex(arg)
+	key := func(line string) string { return re.FindString(line) }
+	if uniqCount {
+		return newUniqCounter(key)
+	}
+
+	set := &exactSet{lines: map[string]struct{}{}}
+	var mu sync.Mutex
+	return func(line, arg string) (string, error) {
+		k := key(line)
+		if k == "" {
+			return line, nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if set.seen(k) {
+			return "", nil
+		}
+		return line, nil
+	}
+}
+
+func parseUniqSize(size string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil || n < 1 {
+		fatalf("`%s` is not a valid uniq size", size)
+	}
+	return n
+}
+
+type exactSet struct {
+	lines map[string]struct{}
+}
+
+func (s *exactSet) seen(line string) bool {
+	if _, ok := s.lines[line]; ok {
+		return true
+	}
+	s.lines[line] = struct{}{}
+	return false
+}
+
+// lruSet remembers a bounded number of lines, forgetting
+// the least recently seen ones first
+type lruSet struct {
+	size    int
+	lines   map[string]*list.Element
+	recency *list.List
+}
+
+func newLRUSet(size int) *lruSet {
+	return &lruSet{size: size, lines: map[string]*list.Element{}, recency: list.New()}
+}
+
+func (s *lruSet) seen(line string) bool {
+	if elem, ok := s.lines[line]; ok {
+		s.recency.MoveToFront(elem)
+		return true
+	}
+
+	s.lines[line] = s.recency.PushFront(line)
+	if s.recency.Len() > s.size {
+		oldest := s.recency.Back()
+		s.recency.Remove(oldest)
+		delete(s.lines, oldest.Value.(string))
+	}
+	return false
+}
+
+// bloomFilter remembers lines in a fixed amount of memory. Lines are
+// never forgotten, but unseen lines may be reported as seen
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+// newBloomFilter sizes a filter for n lines with the provided false positive rate
+func newBloomFilter(n int, rate float64) *bloomFilter {
+	size := uint64(math.Ceil(-float64(n) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	hashes := max(1, int(math.Round(float64(size)/float64(n)*math.Ln2)))
+
+	return &bloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+func (b *bloomFilter) seen(line string) bool {
+	// double hashing derives all positions from a single hash
+	h := hash64(line)
+	h1, h2 := h>>32, h&math.MaxUint32|1
+
+	seen := true
+	for i := 0; i < b.hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % b.size
+		word, bit := pos/64, uint64(1)<<(pos%64)
+		if b.bits[word]&bit == 0 {
+			seen = false
+			b.bits[word] |= bit
+		}
+	}
+	return seen
+}
+
+type uniqEntry struct {
+	line  string
+	count int
+}
+
+// uniqCounter counts the lines sharing a key. With -uniq-count, uniq
+// stages hold back all lines, printing the first line of each key
+// with its count once input ends
+type uniqCounter struct {
+	mu      sync.Mutex
+	key     func(line string) string
+	keys    map[string]*uniqEntry
+	entries []*uniqEntry
+}
+
+func newUniqCounter(key func(line string) string) operator {
+	c := &uniqCounter{key: key, keys: map[string]*uniqEntry{}}
+	deferredStages = append(deferredStages, c)
+
+	return func(line, arg string) (string, error) {
+		k := c.key(line)
+		if k == "" {
+			return line, nil
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if entry, ok := c.keys[k]; ok {
+			entry.count++
+			return "", nil
+		}
+		entry := &uniqEntry{line: line, count: 1}
+		c.keys[k] = entry
+		c.entries = append(c.entries, entry)
+		return "", nil
+	}
+}
+
+// records returns the first line of each key with
+// its count, like `uniq -c` does
+func (c *uniqCounter) records(name string) [][][]string {
+	var records [][][]string
+	for _, entry := range c.entries {
+		records = append(records, [][]string{{strconv.Itoa(entry.count), "count"}, {entry.line, name}})
+	}
+	if columns == nil {
+		columns = []string{"count", name}
+	}
+	return records
+}
+
+// setupUniqCount validates the pipelines counted by -uniq-count
+func setupUniqCount() {
+	if !uniqCount {
+		return
+	}
+	if countMatches {
+		fatalf("-uniq-count cannot be used with -count")
+	}
+
+	var counted int
+	for _, cmds := range pipelines {
+		for _, cmd := range cmds {
+			switch canonical(cmd.Name) {
+			case "uniq":
+				if mode, _, _ := strings.Cut(cmd.Arg, "/"); mode == uniqLRU || mode == uniqBloom {
+					fatalf("-uniq-count cannot count duplicates of uniq(%s), as it does not remember every line", cmd.Arg)
+				}
+				counted++
+			case "uniqby":
+				counted++
+			}
+		}
+	}
+
+	if counted == 0 {
+		fatalf("-uniq-count requires at least one pipeline ending with uniq or uniqby")
+	}
+}
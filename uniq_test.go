@@ -0,0 +1,75 @@
+package patman
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUniq(t *testing.T) {
+	t.Run("Should forget least recently seen lines", func(t *testing.T) {
+		set := newLRUSet(2)
+		assert.False(t, set.seen("a"))
+		assert.False(t, set.seen("b"))
+		assert.True(t, set.seen("a"))
+		assert.False(t, set.seen("c"))
+		assert.False(t, set.seen("b"))
+	})
+
+	t.Run("Should bound bloom filter false positives", func(t *testing.T) {
+		b := newBloomFilter(10000, bloomFalsePositiveRate)
+		for i := 0; i < 10000; i++ {
+			b.seen(strconv.Itoa(i))
+		}
+		for i := 0; i < 10000; i++ {
+			assert.True(t, b.seen(strconv.Itoa(i)))
+		}
+
+		var falsePositives int
+		for i := 10000; i < 11000; i++ {
+			if b.seen(strconv.Itoa(i)) {
+				falsePositives++
+			}
+		}
+		assert.Less(t, falsePositives, 20)
+	})
+}
+
+func TestUniqBy(t *testing.T) {
+	t.Run("Should dedupe lines by key", func(t *testing.T) {
+		op := newUniqBy(`ERROR.*`)
+		lines := []string{"1 ERROR a", "2 ERROR b", "3 ERROR a", "4 info", "5 info"}
+
+		var kept []string
+		for _, line := range lines {
+			if out, _ := op(line, ""); out != "" {
+				kept = append(kept, out)
+			}
+		}
+		assert.Equal(t, []string{"1 ERROR a", "2 ERROR b", "4 info", "5 info"}, kept)
+	})
+}
+
+func TestHyperLogLog(t *testing.T) {
+	t.Run("Should estimate distinct values", func(t *testing.T) {
+		for _, n := range []int{10, 1000, 1000000} {
+			h := newHyperLogLog()
+			for i := 0; i < n; i++ {
+				h.add(strconv.Itoa(i))
+				h.add(strconv.Itoa(i))
+			}
+			assert.InEpsilon(t, n, h.count(), 0.03, n)
+		}
+	})
+
+	t.Run("Should merge sketches", func(t *testing.T) {
+		a, b := newHyperLogLog(), newHyperLogLog()
+		for i := 0; i < 50000; i++ {
+			a.add(strconv.Itoa(i))
+			b.add(strconv.Itoa(i + 25000))
+		}
+		a.merge(b)
+		assert.InEpsilon(t, 75000, a.count(), 0.03)
+	})
+}